@@ -16,37 +16,141 @@ package blacklist
 
 import (
 	"bufio"
+	"fmt"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/iqhive/go-iptree/iptree"
 )
 
+// Blacklist keeps its entries in T and answers IsBlacklisted and
+// BlacklistedBy from a published snapshot of T, so lists can be extended or
+// reloaded while lookups are in flight. A Blacklist must be made by New.
+//
+// The Blacklist methods publish their changes themselves. Changes made to T
+// directly reach lookups once Publish is called, and must not be made while
+// Blacklist methods run. Keeping the snapshot up to date costs a copy of the
+// path to every changed entry.
 type Blacklist struct {
 	T *iptree.IPTree
+
+	mu   sync.Mutex // serializes changes made through Blacklist methods
+	live *iptree.AtomicIPTree
 }
 
 func New() *Blacklist {
 	t := new(Blacklist)
 	t.T = iptree.New()
-	t.T.AddByString("0.0.0.0/0", 0)
+	t.T.AddByString(notListed, 0)
+	t.live = iptree.NewAtomic(t.T.Snapshot())
 	return t
 }
 
+// notListed is the default entry of every blacklist.
+const notListed = "0.0.0.0/0"
+
+// Publish makes the changes made to T directly visible to lookups.
+func (b *Blacklist) Publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.live.Store(b.T.Snapshot())
+}
+
+// AddEntry adds a single CIDR, address or range to the blacklist.
 func (b *Blacklist) AddEntry(cidr string) error {
-	return b.T.AddByString(cidr, 1)
+	return b.AddEntries(cidr)
 }
 
+// AddEntries adds the given CIDRs, addresses and ranges to the blacklist,
+// publishing them together. Nothing is added if any of them is invalid.
+func (b *Blacklist) AddEntries(cidrs ...string) error {
+	return b.add(func(add func(entry string) error) error {
+		for _, cidr := range cidrs {
+			if err := add(cidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ParseFromFile adds the entries listed in path to the blacklist. They become
+// visible to lookups together once the whole file has been read, and are not
+// added at all if a line holds no valid CIDR, address or range. Blank lines
+// and lines starting with # are skipped.
 func (b *Blacklist) ParseFromFile(path string) error {
+	return b.add(func(add func(entry string) error) error {
+		return parseFile(path, add)
+	})
+}
+
+// add adds the entries list passes to its add function to T and publishes
+// them, or adds none if list fails. Entries are checked against a copy of the
+// current snapshot first, so T is left unchanged by an invalid one.
+func (b *Blacklist) add(list func(add func(entry string) error) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.T.Snapshot()
+	var entries []string
+	err := list(func(entry string) error {
+		var err error
+		p, err = p.InsertByString(entry, 1)
+		entries = append(entries, entry)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.T.AddBatch(entries, 1); err != nil {
+		return err
+	}
+	b.live.Store(b.T.Snapshot())
+	return nil
+}
+
+// Reload replaces the whole blacklist, T included, with the entries listed in
+// path. Lookups keep using the previous entries until the file has been read
+// completely, and do so for good if reading fails.
+func (b *Blacklist) Reload(path string) error {
+	builder := iptree.NewBuilder[any](0)
+	builder.AddByString(notListed, 0)
+	err := parseFile(path, func(entry string) error {
+		return builder.AddByString(entry, 1)
+	})
+	if err != nil {
+		return err
+	}
+	p := builder.Persistent()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.T = p.Tree()
+	b.live.Store(p)
+	return nil
+}
+
+// parseFile calls add with every entry listed in path.
+func parseFile(path string, add func(entry string) error) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	for line := 1; scanner.Scan(); line++ {
 		words := strings.Fields(scanner.Text())
-		b.AddEntry(words[0])
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		entry := words[0]
+		if len(words) >= 3 && words[1] == "-" {
+			// Ranges written as "first - last", as in WHOIS inetnum.
+			entry = words[0] + "-" + words[2]
+		}
+		if err := add(entry); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return err
@@ -55,13 +159,23 @@ func (b *Blacklist) ParseFromFile(path string) error {
 }
 
 func (b *Blacklist) IsBlacklisted(ip string) (bool, error) {
-	r, _, err := b.T.GetByString(ip)
+	r, found, err := b.live.GetByString(ip)
 	if err != nil {
 		return false, err
 	}
-	if r.(int) == 0 {
+	if !found || r == 0 {
 		return false, nil
 	} else {
 		return true, nil
 	}
 }
+
+// BlacklistedBy reports whether ip is blacklisted along with the entry that
+// made the decision, which is the default 0.0.0.0/0 entry when it is not.
+func (b *Blacklist) BlacklistedBy(ip string) (bool, netip.Prefix, error) {
+	r, prefix, found, err := b.live.GetWithPrefixByString(ip)
+	if err != nil {
+		return false, netip.Prefix{}, err
+	}
+	return found && r != 0, prefix, nil
+}
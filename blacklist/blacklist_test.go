@@ -14,7 +14,16 @@
 
 package blacklist
 
-import "testing"
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iqhive/go-iptree/iptree"
+)
 
 func TestCreate(t *testing.T) {
 	i := New()
@@ -32,5 +41,154 @@ func TestBlacklist(t *testing.T) {
 	if val, _ := bl.IsBlacklisted("148.73.0.0"); val != true {
 		t.Error("Does not set exact value correctly.")
 	}
+	if val, prefix, _ := bl.BlacklistedBy("148.73.0.0"); val != true || prefix.String() != "148.73.0.0/16" {
+		t.Errorf("Blacklist decision made by %s", prefix)
+	}
+}
+
+func TestReload(t *testing.T) {
+	bl := New()
+	bl.AddEntry("1.2.3.0/24")
+	if val, _ := bl.IsBlacklisted("1.2.3.4"); val != true {
+		t.Error("AddEntry did not blacklist 1.2.3.4")
+	}
+	if err := bl.Reload("example-blacklist.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := bl.IsBlacklisted("1.2.3.4"); val != false {
+		t.Error("Reload kept an entry not in the file")
+	}
+	if val, _ := bl.IsBlacklisted("148.73.0.0"); val != true {
+		t.Error("Reload did not load the file")
+	}
+	if err := bl.Reload("missing.conf"); err == nil {
+		t.Error("Expected error reloading a missing file")
+	}
+	if val, _ := bl.IsBlacklisted("148.73.0.0"); val != true {
+		t.Error("Failed reload dropped the loaded entries")
+	}
+}
+
+func TestAddEntries(t *testing.T) {
+	bl := New()
+	if err := bl.AddEntries("1.2.3.0/24", "5.6.7.8", "10.0.0.0-10.0.0.9"); err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]bool{"1.2.3.4": true, "5.6.7.8": true, "10.0.0.9": true, "10.0.0.10": false} {
+		if val, _ := bl.IsBlacklisted(ip); val != expected {
+			t.Errorf("IsBlacklisted(%s) returned %v", ip, val)
+		}
+	}
+	if err := bl.AddEntries("9.9.9.0/24", "9.9.9.0/33"); !errors.Is(err, iptree.ErrInvalidPrefix) {
+		t.Fatalf("AddEntries returned %v, expected ErrInvalidPrefix", err)
+	}
+	if val, _ := bl.IsBlacklisted("9.9.9.9"); val != false {
+		t.Error("Failed AddEntries published part of its entries")
+	}
+}
 
+func TestRanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.conf")
+	list := "1.2.3.4-1.2.5.17  # abuse feed\n5.6.7.0 - 5.6.7.127  # inetnum\n2001:db8::-2001:db8::ff\n"
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bl := New()
+	if err := bl.ParseFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]bool{
+		"1.2.3.4": true, "1.2.4.99": true, "1.2.5.18": false,
+		"5.6.7.127": true, "5.6.7.128": false,
+		"2001:db8::ff": true, "2001:db8::100": false,
+	} {
+		if val, _ := bl.IsBlacklisted(ip); val != expected {
+			t.Errorf("IsBlacklisted(%s) returned %v", ip, val)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "comments.conf")
+	if err := os.WriteFile(path, []byte("# header comment\n1.2.3.0/24\n  #indented\n\n5.6.7.8  # trailing\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bl := New()
+	if err := bl.ParseFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+		if val, _ := bl.IsBlacklisted(ip); val != true {
+			t.Errorf("IsBlacklisted(%s) returned false", ip)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.conf")
+	if err := os.WriteFile(path, []byte("1.2.3.0/24\n1.2.4.0/33  # typo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bl := New()
+	err := bl.ParseFromFile(path)
+	if !errors.Is(err, iptree.ErrInvalidPrefix) {
+		t.Fatalf("ParseFromFile returned %v, expected ErrInvalidPrefix", err)
+	}
+	if !strings.Contains(err.Error(), "bad.conf:2") {
+		t.Errorf("Error %q does not name the failing line", err)
+	}
+	if val, _ := bl.IsBlacklisted("1.2.3.4"); val != false {
+		t.Error("Failed parse published part of the file")
+	}
+	if _, err := bl.IsBlacklisted("1.2.3"); !errors.Is(err, iptree.ErrInvalidPrefix) {
+		t.Errorf("IsBlacklisted returned %v, expected ErrInvalidPrefix", err)
+	}
+}
+
+func TestWalkEntries(t *testing.T) {
+	bl := New()
+	bl.AddEntries("1.2.3.0/24", "2001:db8::/32")
+	var listed []string
+	bl.T.WalkV4Prefix(func(prefix netip.Prefix, value any) error {
+		if value != 0 {
+			listed = append(listed, prefix.String())
+		}
+		return nil
+	})
+	for prefix := range bl.T.AllV6() {
+		listed = append(listed, prefix.String())
+	}
+	if strings.Join(listed, " ") != "1.2.3.0/24 2001:db8::/32" {
+		t.Errorf("Walked %v", listed)
+	}
+	if bl.T.LenV4() != 2 || !bl.T.HasPrefix(netip.MustParsePrefix("1.2.3.0/24")) {
+		t.Errorf("T holds %v", bl.T.GetAll())
+	}
+}
+
+func TestPublish(t *testing.T) {
+	bl := New()
+	if err := bl.T.AddByString("1.2.3.0/24", 1); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := bl.IsBlacklisted("1.2.3.4"); val != false {
+		t.Error("A change to T reached lookups before Publish")
+	}
+	bl.Publish()
+	if val, _ := bl.IsBlacklisted("1.2.3.4"); val != true {
+		t.Error("Publish did not publish the change to T")
+	}
+
+	if err := bl.AddEntries("5.6.7.8", "5.6.7.9/33"); err == nil {
+		t.Fatal("Expected error adding an invalid entry")
+	}
+	if bl.T.Len() != 2 {
+		t.Errorf("Failed AddEntries changed T: %v", bl.T.GetAll())
+	}
+	if err := bl.Reload("example-blacklist.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := bl.T.GetByString("148.73.0.0"); val != 1 {
+		t.Errorf("T holds %v for a reloaded entry", val)
+	}
 }
@@ -0,0 +1,83 @@
+package iptree
+
+// Equal reports whether a and b are equal. It can be passed to Aggregate and
+// Compact for trees holding comparable values.
+func Equal[V comparable](a, b V) bool {
+	return a == b
+}
+
+// Aggregate returns a tree giving every address the same value as i, using as
+// few entries as it can: sibling prefixes with equal values are merged into
+// their parent, and entries with the same value as the entry covering them
+// are dropped. Addresses not covered by i stay uncovered.
+func (i *Tree[V]) Aggregate(equal func(a, b V) bool) *Tree[V] {
+	p := i.snapshot()
+	for _, root := range []*pnode[V]{p.v4, p.v6} {
+		mergeSiblings(root, equal)
+		var cover V
+		dropRedundant(root, cover, false, equal)
+	}
+	agg := p.tree()
+	for name, z := range i.zones {
+		agg.setZone(name, z.Aggregate(equal))
+	}
+	return agg
+}
+
+// Compact aggregates the tree in place, as Aggregate does, returning the
+// number of entries before and after.
+func (i *Tree[V]) Compact(equal func(a, b V) bool) (before, after int) {
+	before = i.Len()
+	agg := i.Aggregate(equal)
+	agg.setOptions(i.opts)
+	agg.parent, agg.name = i.parent, i.name
+	tracked := i.snap != nil
+	*i = *agg
+	for _, z := range i.zones {
+		z.parent = i
+	}
+	if tracked {
+		i.track(i.Snapshot())
+	}
+	return before, i.Len()
+}
+
+// mergeSiblings replaces pairs of sibling entries with equal values by a
+// single entry at their parent, working up from the most specific entries so
+// merges cascade. The parent's own value, if any, is covered by the siblings
+// and so never seen by a lookup.
+func mergeSiblings[V any](n *pnode[V], equal func(a, b V) bool) {
+	if n == nil {
+		return
+	}
+	mergeSiblings(n.left, equal)
+	mergeSiblings(n.right, equal)
+	if n.left == nil || n.right == nil || !n.left.ok || !n.right.ok {
+		return
+	}
+	if !equal(n.left.value, n.right.value) {
+		return
+	}
+	var zero V
+	n.value, n.ok = n.left.value, true
+	n.left.value, n.left.ok = zero, false
+	n.right.value, n.right.ok = zero, false
+}
+
+// dropRedundant removes entries whose value equals that of the closest entry
+// covering them.
+func dropRedundant[V any](n *pnode[V], cover V, covered bool, equal func(a, b V) bool) {
+	if n == nil {
+		return
+	}
+	if n.ok {
+		if covered && equal(cover, n.value) {
+			var zero V
+			n.value, n.ok = zero, false
+		} else {
+			cover, covered = n.value, true
+		}
+	}
+	dropRedundant(n.left, cover, covered, equal)
+	dropRedundant(n.right, cover, covered, equal)
+}
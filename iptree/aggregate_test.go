@@ -0,0 +1,68 @@
+package iptree
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	ip := NewTree[int]()
+	for n := 0; n < 4; n++ {
+		ip.AddByString(fmt.Sprintf("192.168.%d.0/24", n), 1)
+	}
+	ip.AddByString("192.168.4.0/24", 2)
+	ip.AddByString("10.0.0.0/8", 3)
+	ip.AddByString("10.1.0.0/16", 3)
+	ip.AddByString("10.1.2.0/24", 4)
+	ip.AddByString("10.1.2.128/25", 3)
+	ip.AddByString("2001:db8::/33", 5)
+	ip.AddByString("2001:db8:8000::/33", 5)
+
+	agg := ip.Aggregate(Equal[int])
+	got := entriesOf(agg)
+	expected := []string{
+		"10.0.0.0/8=3", "10.1.2.0/24=4", "10.1.2.128/25=3",
+		"192.168.0.0/22=1", "192.168.4.0/24=2",
+		"2001:db8::/32=5",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Aggregate returned %v, expected %v", got, expected)
+	}
+	if ip.Len() != 11 {
+		t.Errorf("Aggregate changed the original tree")
+	}
+
+	// Every address keeps its value, and addresses that were not covered
+	// stay uncovered.
+	for _, addr := range []string{"192.168.0.1", "192.168.3.255", "192.168.4.1", "192.168.5.1", "10.1.2.1", "10.1.2.200", "10.2.0.0", "2001:db8:ffff::1", "2001:db9::1"} {
+		want, wantFound, _ := ip.GetByString(addr)
+		got, gotFound, _ := agg.GetByString(addr)
+		if got != want || gotFound != wantFound {
+			t.Errorf("Lookup of %s returned %d, %v after aggregation; expected %d, %v", addr, got, gotFound, want, wantFound)
+		}
+	}
+
+	before, after := ip.Compact(Equal[int])
+	if before != 11 || after != 6 || ip.Len() != 6 {
+		t.Errorf("Compact reported %d -> %d entries, tree holds %d", before, after, ip.Len())
+	}
+	if val, _, _ := ip.GetNetIPAddr(netip.MustParseAddr("192.168.2.1")); val != 1 {
+		t.Errorf("Lookup after Compact returned %d", val)
+	}
+}
+
+func TestAggregateOverride(t *testing.T) {
+	// The /8's own value is hidden by its two halves, so it can take theirs.
+	ip := NewTree[string]()
+	ip.AddByString("10.0.0.0/8", "a")
+	ip.AddByString("10.0.0.0/9", "b")
+	ip.AddByString("10.128.0.0/9", "b")
+	ip.AddByString("0.0.0.0/0", "b")
+
+	got := ip.Aggregate(func(a, b string) bool { return a == b }).GetAll()
+	if len(got) != 1 || got["0.0.0.0/0"] != "b" {
+		t.Errorf("Aggregate returned %v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package iptree
+
+import (
+	"iter"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// AtomicTree serves lookups from the current version of a PersistentTree.
+// Lookups read that version without taking any lock, and a new version is
+// published in one step, so readers never see a partially loaded tree.
+//
+// Update derives the next version from the current one, sharing every node
+// its changes do not touch, so adding a single entry copies only the path to
+// it. A tree loaded from scratch is published with Store.
+type AtomicTree[V any] struct {
+	current atomic.Pointer[PersistentTree[V]]
+	mu      sync.Mutex // serializes Update
+}
+
+// AtomicIPTree is the untyped AtomicTree.
+type AtomicIPTree = AtomicTree[any]
+
+// NewAtomic returns an AtomicIPTree serving p, or an empty tree if p is nil.
+func NewAtomic(p *PersistentTree[any]) *AtomicIPTree {
+	return NewAtomicTree(p)
+}
+
+// NewAtomicTree returns an AtomicTree serving p, or an empty tree if p is nil.
+// A Tree is served by passing its Snapshot.
+func NewAtomicTree[V any](p *PersistentTree[V]) *AtomicTree[V] {
+	a := new(AtomicTree[V])
+	a.current.Store(orEmpty(p))
+	return a
+}
+
+// Load returns the current version.
+func (a *AtomicTree[V]) Load() *PersistentTree[V] {
+	return a.current.Load()
+}
+
+// Store publishes p, replacing the current version. A nil p publishes an
+// empty tree.
+func (a *AtomicTree[V]) Store(p *PersistentTree[V]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.current.Store(orEmpty(p))
+}
+
+// Swap publishes p, or an empty tree if p is nil, and returns the version it
+// replaced.
+func (a *AtomicTree[V]) Swap(p *PersistentTree[V]) *PersistentTree[V] {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current.Swap(orEmpty(p))
+}
+
+// Update publishes the version fn derives from the current one, unless fn
+// returns an error. A nil version publishes an empty tree. Concurrent updates
+// are applied one after another.
+func (a *AtomicTree[V]) Update(fn func(p *PersistentTree[V]) (*PersistentTree[V], error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, err := fn(a.current.Load())
+	if err != nil {
+		return err
+	}
+	a.current.Store(orEmpty(p))
+	return nil
+}
+
+// orEmpty returns p, or an empty tree if p is nil, so lookups always have a
+// version to read.
+func orEmpty[V any](p *PersistentTree[V]) *PersistentTree[V] {
+	if p == nil {
+		return NewPersistentTree[V]()
+	}
+	return p
+}
+
+func (a *AtomicTree[V]) Zones() []string {
+	return a.Load().Zones()
+}
+
+func (a *AtomicTree[V]) Len() int {
+	return a.Load().Len()
+}
+
+func (a *AtomicTree[V]) LenV4() int {
+	return a.Load().LenV4()
+}
+
+func (a *AtomicTree[V]) LenV6() int {
+	return a.Load().LenV6()
+}
+
+func (a *AtomicTree[V]) Get(ip net.IP) (V, bool, error) {
+	return a.Load().Get(ip)
+}
+
+func (a *AtomicTree[V]) GetByString(ipstr string) (V, bool, error) {
+	return a.Load().GetByString(ipstr)
+}
+
+func (a *AtomicTree[V]) GetIPNet(ip net.IPNet) (V, bool, error) {
+	return a.Load().GetIPNet(ip)
+}
+
+func (a *AtomicTree[V]) GetNetIP(ip net.IP) (V, bool, error) {
+	return a.Load().GetNetIP(ip)
+}
+
+func (a *AtomicTree[V]) GetNetIPAddr(nip netip.Addr) (V, bool, error) {
+	return a.Load().GetNetIPAddr(nip)
+}
+
+func (a *AtomicTree[V]) GetBatch(addrs []netip.Addr, out []V, found []bool) {
+	a.Load().GetBatch(addrs, out, found)
+}
+
+func (a *AtomicTree[V]) GetWithPrefixByString(ipstr string) (V, netip.Prefix, bool, error) {
+	return a.Load().GetWithPrefixByString(ipstr)
+}
+
+func (a *AtomicTree[V]) GetWithPrefixNetIP(ip net.IP) (V, netip.Prefix, bool, error) {
+	return a.Load().GetWithPrefixNetIP(ip)
+}
+
+func (a *AtomicTree[V]) GetWithPrefixNetIPAddr(nip netip.Addr) (V, netip.Prefix, bool, error) {
+	return a.Load().GetWithPrefixNetIPAddr(nip)
+}
+
+func (a *AtomicTree[V]) GetAllMatches(nip netip.Addr) []Entry[V] {
+	return a.Load().GetAllMatches(nip)
+}
+
+func (a *AtomicTree[V]) GetAllMatchesByString(ipstr string) ([]Entry[V], error) {
+	return a.Load().GetAllMatchesByString(ipstr)
+}
+
+func (a *AtomicTree[V]) GetExact(prefix netip.Prefix) (V, bool) {
+	return a.Load().GetExact(prefix)
+}
+
+func (a *AtomicTree[V]) GetExactByString(ipcidr string) (V, bool, error) {
+	return a.Load().GetExactByString(ipcidr)
+}
+
+func (a *AtomicTree[V]) GetExactIPNet(cidr *net.IPNet) (V, bool, error) {
+	return a.Load().GetExactIPNet(cidr)
+}
+
+func (a *AtomicTree[V]) HasPrefix(prefix netip.Prefix) bool {
+	return a.Load().HasPrefix(prefix)
+}
+
+func (a *AtomicTree[V]) HasPrefixByString(ipcidr string) (bool, error) {
+	return a.Load().HasPrefixByString(ipcidr)
+}
+
+func (a *AtomicTree[V]) HasPrefixIPNet(cidr *net.IPNet) (bool, error) {
+	return a.Load().HasPrefixIPNet(cidr)
+}
+
+func (a *AtomicTree[V]) GetAll() map[string]V {
+	return a.Load().GetAll()
+}
+
+func (a *AtomicTree[V]) GetAllWithin(prefix netip.Prefix) []Entry[V] {
+	return a.Load().GetAllWithin(prefix)
+}
+
+func (a *AtomicTree[V]) WalkWithin(prefix netip.Prefix, callback func(prefix netip.Prefix, value V) error) error {
+	return a.Load().WalkWithin(prefix, callback)
+}
+
+func (a *AtomicTree[V]) WalkV4Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return a.Load().WalkV4Prefix(callback)
+}
+
+func (a *AtomicTree[V]) WalkV4String(callback func(prefix string, value V) error) error {
+	return a.Load().WalkV4String(callback)
+}
+
+func (a *AtomicTree[V]) WalkV6Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return a.Load().WalkV6Prefix(callback)
+}
+
+func (a *AtomicTree[V]) WalkV6String(callback func(prefix string, value V) error) error {
+	return a.Load().WalkV6String(callback)
+}
+
+// All returns an iterator over the entries of the version current when the
+// iteration starts, as do AllV4, AllV6 and Within.
+func (a *AtomicTree[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		a.Load().All()(yield)
+	}
+}
+
+func (a *AtomicTree[V]) AllV4() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		a.Load().AllV4()(yield)
+	}
+}
+
+func (a *AtomicTree[V]) AllV6() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		a.Load().AllV6()(yield)
+	}
+}
+
+func (a *AtomicTree[V]) Within(prefix netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		a.Load().Within(prefix)(yield)
+	}
+}
@@ -0,0 +1,110 @@
+package iptree
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestAtomicTree(t *testing.T) {
+	ip := NewAtomicTree[int](nil)
+	if ip.Len() != 0 {
+		t.Error("New atomic tree is not empty")
+	}
+
+	before := ip.Load()
+	err := ip.Update(func(p *PersistentTree[int]) (*PersistentTree[int], error) {
+		return p.InsertByString("10.0.0.0/8", 1)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if before.Len() != 0 {
+		t.Error("Update modified the published snapshot")
+	}
+	if val, found, _ := ip.GetByString("10.1.1.1"); !found || val != 1 {
+		t.Errorf("Lookup after Update returned %d, %v", val, found)
+	}
+
+	// Updates share the nodes they do not change with the previous version.
+	before = ip.Load()
+	ip.Update(func(p *PersistentTree[int]) (*PersistentTree[int], error) {
+		return p.InsertByString("2001:db8::/32", 5)
+	})
+	if after := ip.Load(); after.v4 != before.v4 || after.Len() != 2 {
+		t.Error("Update copied the nodes it did not change")
+	}
+	ip.Update(func(p *PersistentTree[int]) (*PersistentTree[int], error) {
+		p, _ = p.Delete(netip.MustParsePrefix("2001:db8::/32"))
+		return p, nil
+	})
+
+	err = ip.Update(func(p *PersistentTree[int]) (*PersistentTree[int], error) {
+		p, _ = p.InsertByString("11.0.0.0/8", 2)
+		return p, fmt.Errorf("abandoned")
+	})
+	if err == nil || ip.HasPrefix(netip.MustParsePrefix("11.0.0.0/8")) {
+		t.Error("Failed Update was published")
+	}
+
+	replacement := NewTree[int]()
+	replacement.AddByString("2001:db8::/32", 3)
+	old := ip.Swap(replacement.Snapshot())
+	if old.Len() != 1 || ip.Len() != 1 {
+		t.Errorf("Swap returned %d entries and serves %d", old.Len(), ip.Len())
+	}
+	if val, found, _ := ip.GetNetIPAddr(netip.MustParseAddr("2001:db8::1")); !found || val != 3 {
+		t.Errorf("Lookup after Swap returned %d, %v", val, found)
+	}
+
+	ip.Store(nil)
+	if _, found, err := ip.GetByString("2001:db8::1"); found || err != nil || ip.Len() != 0 {
+		t.Errorf("Store(nil) left %d entries: %v, %v", ip.Len(), found, err)
+	}
+}
+
+// TestAtomicTreeConcurrent is meant to be run with the race detector.
+func TestAtomicTreeConcurrent(t *testing.T) {
+	full := func(n int) *PersistentTree[int] {
+		tree := NewTree[int]()
+		for b := 0; b < 64; b++ {
+			tree.AddByString(fmt.Sprintf("10.%d.0.0/16", b), n)
+		}
+		return tree.Snapshot()
+	}
+	ip := NewAtomicTree(full(0))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 1; n < 50; n++ {
+			if n%2 == 0 {
+				ip.Store(full(n))
+			} else {
+				ip.Update(func(p *PersistentTree[int]) (*PersistentTree[int], error) {
+					return p.InsertByString("192.168.0.0/16", n)
+				})
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				// Every published tree is complete, so all 64 entries are
+				// visible together.
+				if l := ip.Load().LenV4(); l < 64 {
+					t.Errorf("Saw a partially loaded tree with %d entries", l)
+				}
+				addr := netip.AddrFrom4([4]byte{10, byte(n % 64), 1, 1})
+				if _, found, _ := ip.GetNetIPAddr(addr); !found {
+					t.Errorf("Lookup of %s failed", addr)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package iptree
+
+import (
+	"math/bits"
+	"net/netip"
+	"slices"
+
+	"github.com/iqhive/nradix"
+)
+
+// GetBatch looks up every address of addrs, storing the value of its longest
+// matching prefix in out and whether there was one in found, both of which
+// must be at least as long as addrs; GetBatch panics otherwise. Invalid
+// addresses are reported as not found.
+//
+// Addresses are looked up in address order, each sharing with the one before
+// it the part of the descent their common leading bits allow. Unsorted input
+// is first sorted through an index, which takes an allocation and most of the
+// time saved: in the package's benchmarks it is looked up about 20% faster
+// than with a GetNetIPAddr loop, while sorted input is about four times as
+// fast again. Callers that can keep their addresses sorted should.
+func (i *Tree[V]) GetBatch(addrs []netip.Addr, out []V, found []bool) {
+	_, _ = out[:len(addrs)], found[:len(addrs)]
+
+	// path[d] is the node at depth d on the path of the previous address,
+	// and best[d] the deepest node holding an entry from the start of that
+	// path down to d. Both are valid up to depth reached.
+	var path, best [129]*nradix.Node
+	var prev [16]byte
+	var prevIs4 bool
+	reached := -1
+
+	order := batchOrder(addrs)
+	for j := range addrs {
+		k := j
+		if order != nil {
+			k = order[j]
+		}
+		addr := addrs[k]
+		if !addr.IsValid() {
+			var zero V
+			out[k], found[k] = zero, false
+			continue
+		}
+		if addr.Is4In6() || i.scope(addr.Zone()) != nil {
+			// Left to the policies, which only apply to these.
+			out[k], found[k], _ = i.get(netip.PrefixFrom(addr, addr.BitLen()), addr.Zone())
+			continue
+		}
+		key := addr.As16()
+		is4 := addr.Is4()
+
+		var depth int
+		if reached >= 0 && is4 == prevIs4 {
+			depth = min(commonBits(&prev, &key), reached)
+		} else {
+			var n *nradix.Node
+			n, depth = i.start(is4)
+			path[depth], best[depth] = n, nil
+			if n != nil && n.GetValue() != nil {
+				best[depth] = n
+			}
+		}
+
+		if n := path[depth]; n == nil {
+			reached = -1
+		} else {
+			for depth < 128 {
+				c := child(n, &key, depth)
+				if c == nil {
+					break
+				}
+				n = c
+				depth++
+				path[depth], best[depth] = n, best[depth-1]
+				if n.GetValue() != nil {
+					best[depth] = n
+				}
+			}
+			reached = depth
+		}
+		prev, prevIs4 = key, is4
+
+		if reached < 0 || best[reached] == nil {
+			var zero V
+			out[k], found[k] = zero, false
+			continue
+		}
+		out[k], found[k], _ = typed[V](best[reached].GetValue(), nil)
+	}
+}
+
+// commonBits returns the number of leading bits a and b have in common.
+// batchOrder returns the positions of addrs in address order, or nil if addrs
+// are in that order already.
+func batchOrder(addrs []netip.Addr) []int {
+	if slices.IsSortedFunc(addrs, netip.Addr.Compare) {
+		return nil
+	}
+	order := make([]int, len(addrs))
+	for k := range order {
+		order[k] = k
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return addrs[a].Compare(addrs[b])
+	})
+	return order
+}
+
+func commonBits(a, b *[16]byte) int {
+	for k := range a {
+		if x := a[k] ^ b[k]; x != 0 {
+			return k*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 128
+}
@@ -0,0 +1,61 @@
+package iptree
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// batchAddrs returns n random addresses within or near the prefixes of strs,
+// in the same family as the prefix each was drawn from.
+func batchAddrs(n int) []netip.Addr {
+	r := rand.New(rand.NewSource(1))
+	addrs := make([]netip.Addr, 0, n)
+	for len(addrs) < n {
+		prefix := netip.MustParsePrefix(strs[r.Intn(len(strs))])
+		a := prefix.Addr().As16()
+		for k := prefix.Bits() / 8; k < 16; k++ {
+			a[k] ^= byte(r.Intn(256))
+		}
+		addr := netip.AddrFrom16(a)
+		if prefix.Addr().Is4() {
+			addr = addr.Unmap()
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestGetBatch(t *testing.T) {
+	tree := NewTree[int]()
+	for k, s := range strs {
+		tree.AddByString(s, k)
+	}
+	tree.AddByString("::/0", -1)
+
+	addrs := batchAddrs(5000)
+	addrs = append(addrs, netip.Addr{}, netip.MustParseAddr("::ffff:10.72.1.1"), netip.MustParseAddr("fe80::1%eth0"))
+	sorted := slices.Clone(addrs)
+	slices.SortFunc(sorted, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	for _, batch := range [][]netip.Addr{addrs, sorted} {
+		out := make([]int, len(batch))
+		found := make([]bool, len(batch))
+		tree.GetBatch(batch, out, found)
+		for k, addr := range batch {
+			val, ok, _ := tree.GetNetIPAddr(addr)
+			if out[k] != val || found[k] != ok {
+				t.Fatalf("GetBatch returned %d, %v for %s; GetNetIPAddr returned %d, %v", out[k], found[k], addr, val, ok)
+			}
+		}
+	}
+
+	empty := NewTree[int]()
+	out := []int{7, 7}
+	found := []bool{true, true}
+	empty.GetBatch([]netip.Addr{netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("1.2.3.5")}, out, found)
+	if out[0] != 0 || found[0] || out[1] != 0 || found[1] {
+		t.Errorf("GetBatch on an empty tree returned %v, %v", out, found)
+	}
+}
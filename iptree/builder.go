@@ -0,0 +1,199 @@
+package iptree
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// Builder collects the entries of a new tree and builds it in one go. Entries
+// are sorted into address order, unless they were added in that order
+// already, and duplicates are dropped.
+//
+// Persistent builds a PersistentTree bottom-up from the sorted entries: it
+// counts the nodes they need, allocates them in one block and links them
+// without descending from the root for each entry. In the package's
+// benchmarks that is 3 to 7 times as fast as inserting one entry at a time.
+//
+// Tree is not built bottom-up and gives no such speedup. nradix allocates the
+// nodes of a Tree itself, so Tree inserts each entry from the root, only
+// skipping the checks each add does. In the same benchmarks it is anywhere
+// from level with to 1.5 times as fast as adding the entries one at a time.
+//
+// The tree is built with the default policies. A prefix added more than once
+// keeps the last value added.
+type Builder[V any] struct {
+	entries []builderEntry[V]
+	sorted  bool
+}
+
+type builderEntry[V any] struct {
+	Entry[V]
+	seq int // position in the order added
+}
+
+// NewBuilder returns an empty Builder with room for size entries.
+func NewBuilder[V any](size int) *Builder[V] {
+	return &Builder[V]{entries: make([]builderEntry[V], 0, size), sorted: true}
+}
+
+// Len returns the number of entries added so far, counting duplicates.
+func (b *Builder[V]) Len() int {
+	return len(b.entries)
+}
+
+// Add adds v at prefix. Host bits are masked off.
+func (b *Builder[V]) Add(prefix netip.Prefix, v V) error {
+	if !prefix.IsValid() {
+		return invalidPrefix(prefix.String(), nil)
+	}
+	b.add(normalizePrefix(prefix), v)
+	return nil
+}
+
+// AddByString adds v at the given CIDR, bare address or range, as
+// Tree.AddByString does.
+func (b *Builder[V]) AddByString(ipcidr string, v V) error {
+	if isRange(ipcidr) {
+		from, to, err := parseRange(ipcidr)
+		if err != nil {
+			return err
+		}
+		prefixes, err := RangePrefixes(from, to)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			b.add(normalizePrefix(prefix), v)
+		}
+		return nil
+	}
+	prefix, err := parsePrefixOrAddr(ipcidr)
+	if err != nil {
+		return err
+	}
+	b.add(normalizePrefix(prefix), v)
+	return nil
+}
+
+func (b *Builder[V]) add(prefix netip.Prefix, v V) {
+	if n := len(b.entries); n > 0 && comparePrefixes(b.entries[n-1].Prefix, prefix) > 0 {
+		b.sorted = false
+	}
+	b.entries = append(b.entries, builderEntry[V]{Entry[V]{Prefix: prefix, Value: v}, len(b.entries)})
+}
+
+// Tree returns a tree holding the entries added so far and empties the
+// Builder. The entries are inserted one at a time from the root, in address
+// order.
+func (b *Builder[V]) Tree() (*Tree[V], error) {
+	t := NewTree[V]()
+	for _, e := range b.take() {
+		if err := t.R.SetCIDRNetIPPrefix(e.Prefix, e.Value, true); err != nil {
+			return nil, &PrefixError{Op: "add", Input: e.Prefix.String(), Err: err}
+		}
+		t.count(e.Prefix, 1)
+	}
+	t.refreshV4()
+	return t, nil
+}
+
+// Persistent returns a PersistentTree holding the entries added so far and
+// empties the Builder. Its nodes are allocated in one block, which stays in
+// memory as long as any version derived from the tree uses one of them.
+func (b *Builder[V]) Persistent() *PersistentTree[V] {
+	entries := b.take()
+	v6 := len(entries)
+	for k, e := range entries {
+		if !e.Prefix.Addr().Is4() {
+			v6 = k
+			break
+		}
+	}
+	p := NewPersistentTree[V]()
+	p.v4, p.v4Len = pbuild(entries[:v6]), v6
+	p.v6, p.v6Len = pbuild(entries[v6:]), len(entries)-v6
+	return p
+}
+
+// take empties the Builder and returns its entries in address order, IPv4
+// first, with the last value added for each prefix.
+func (b *Builder[V]) take() []builderEntry[V] {
+	entries := b.entries
+	if !b.sorted {
+		// Ties keep the order added, so the last of several values for a
+		// prefix stays last.
+		slices.SortFunc(entries, func(x, y builderEntry[V]) int {
+			if c := comparePrefixes(x.Prefix, y.Prefix); c != 0 {
+				return c
+			}
+			return x.seq - y.seq
+		})
+	}
+	b.entries, b.sorted = nil, true
+
+	kept := entries[:0]
+	for k, e := range entries {
+		if k+1 < len(entries) && entries[k+1].Prefix == e.Prefix {
+			continue
+		}
+		// A nil value is no entry in a Tree, see store, and Persistent
+		// builds the same entries.
+		if any(e.Value) == nil {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// pbuild returns the root of the nodes holding entries, which are of one
+// address family and in address order, or nil if there are none.
+//
+// In address order each entry shares the path from the root with the one
+// before it down to the depth where their keys part, or the shorter of the two
+// ends, and needs new nodes only below that. The nodes are counted first and
+// then taken from one block, each linked below the last node at the depth
+// above it.
+func pbuild[V any](entries []builderEntry[V]) *pnode[V] {
+	if len(entries) == 0 {
+		return nil
+	}
+	size := 1
+	var prev [16]byte
+	prevBits := 0
+	for _, e := range entries {
+		key, bits := pkey(e.Prefix)
+		size += bits - min(commonBits(&prev, &key), prevBits, bits)
+		prev, prevBits = key, bits
+	}
+
+	nodes := make([]pnode[V], size)
+	var path [129]*pnode[V] // path[depth] is the last node linked at depth
+	path[0] = &nodes[0]
+	next := 1
+	prevBits = 0
+	for _, e := range entries {
+		key, bits := pkey(e.Prefix)
+		for depth := min(commonBits(&prev, &key), prevBits, bits); depth < bits; depth++ {
+			n := &nodes[next]
+			next++
+			if keyBit(&key, depth) {
+				path[depth].right = n
+			} else {
+				path[depth].left = n
+			}
+			path[depth+1] = n
+		}
+		path[bits].value, path[bits].ok = e.Value, true
+		prev, prevBits = key, bits
+	}
+	return &nodes[0]
+}
+
+// comparePrefixes orders prefixes by address, IPv4 first, and then by length.
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
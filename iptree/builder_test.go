@@ -0,0 +1,119 @@
+package iptree
+
+import (
+	"errors"
+	"maps"
+	"net/netip"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder[int](len(strs))
+	expected := NewTree[int]()
+	for k, s := range strs {
+		if err := b.AddByString(s, k); err != nil {
+			t.Fatal(err)
+		}
+		expected.AddByString(s, k)
+	}
+	b.AddByString("10.0.0.0-10.0.0.9", -1)
+	expected.AddByString("10.0.0.0-10.0.0.9", -1)
+	b.Add(netip.MustParsePrefix("::ffff:1.2.3.4/120"), -2)
+	expected.AddByString("1.2.3.0/24", -2)
+
+	tree, err := b.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(tree.GetAll(), expected.GetAll()) {
+		t.Error("Builder built a different tree than adding one by one")
+	}
+	if tree.Len() != expected.Len() || tree.LenV4() != expected.LenV4() {
+		t.Errorf("Builder counted %d entries, expected %d", tree.Len(), expected.Len())
+	}
+	for _, addr := range batchAddrs(1000) {
+		got, gotFound, _ := tree.GetNetIPAddr(addr)
+		want, wantFound, _ := expected.GetNetIPAddr(addr)
+		if got != want || gotFound != wantFound {
+			t.Fatalf("Lookup of %s returned %d, %v; expected %d, %v", addr, got, gotFound, want, wantFound)
+		}
+	}
+	if b.Len() != 0 {
+		t.Error("Tree did not empty the builder")
+	}
+
+	// Later values for a prefix win, sorted or not.
+	b.AddByString("10.0.0.0/8", 1)
+	b.AddByString("10.0.0.0/8", 2)
+	b.AddByString("9.0.0.0/8", 3)
+	b.AddByString("10.0.0.0/8", 4)
+	tree, _ = b.Tree()
+	if val, _ := tree.GetExact(netip.MustParsePrefix("10.0.0.0/8")); val != 4 || tree.Len() != 2 {
+		t.Errorf("Builder kept %d for a duplicate prefix and %d entries", val, tree.Len())
+	}
+	if err := tree.AddByString("11.0.0.0/8", 5); err != nil || tree.Len() != 3 {
+		t.Errorf("A built tree could not be added to: %v", err)
+	}
+
+	if err := b.AddByString("10.0.0.0/33", 1); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Expected ErrInvalidPrefix, got %v", err)
+	}
+	if err := b.Add(netip.Prefix{}, 1); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Expected ErrInvalidPrefix, got %v", err)
+	}
+}
+
+func TestBuilderPersistent(t *testing.T) {
+	b := NewBuilder[int](len(strs))
+	for k, s := range strs {
+		b.AddByString(s, k)
+	}
+	b.AddByString("10.0.0.0-10.0.0.9", -1)
+	b.AddByString("10.0.0.0/8", -2)
+	b.AddByString("10.0.0.0/8", -3)
+	b.Add(netip.MustParsePrefix("::/0"), -4)
+	b.Add(netip.MustParsePrefix("0.0.0.0/0"), -5)
+	expected := NewTree[int]()
+	for _, e := range b.entries {
+		expected.AddByNetIPAddr(e.Prefix.Addr(), e.Prefix, e.Value, true)
+	}
+
+	p := b.Persistent()
+	if b.Len() != 0 {
+		t.Error("Persistent did not empty the builder")
+	}
+	if !maps.Equal(p.GetAll(), expected.GetAll()) {
+		t.Error("Persistent built a different tree than adding one by one")
+	}
+	if p.Len() != expected.Len() || p.LenV4() != expected.LenV4() {
+		t.Errorf("Persistent counted %d entries, expected %d", p.Len(), expected.Len())
+	}
+	for _, addr := range batchAddrs(1000) {
+		got, gotFound, _ := p.GetNetIPAddr(addr)
+		want, wantFound, _ := expected.GetNetIPAddr(addr)
+		if got != want || gotFound != wantFound {
+			t.Fatalf("Lookup of %s returned %d, %v; expected %d, %v", addr, got, gotFound, want, wantFound)
+		}
+	}
+
+	// The nodes are exactly those inserting the entries creates.
+	snap := expected.Snapshot()
+	if got, want := countNodes(p.v4)+countNodes(p.v6), countNodes(snap.v4)+countNodes(snap.v6); got != want {
+		t.Errorf("Persistent built %d nodes, expected %d", got, want)
+	}
+
+	next := p.Insert(netip.MustParsePrefix("10.1.0.0/16"), 7)
+	if _, found := p.GetExact(netip.MustParsePrefix("10.1.0.0/16")); found || next.Len() != p.Len()+1 {
+		t.Error("Inserting into a built tree changed it")
+	}
+	if NewBuilder[int](0).Persistent().Len() != 0 {
+		t.Error("An empty builder built a non-empty tree")
+	}
+}
+
+func countNodes[V any](n *pnode[V]) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + countNodes(n.left) + countNodes(n.right)
+}
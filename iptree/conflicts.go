@@ -0,0 +1,174 @@
+package iptree
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/iqhive/nradix"
+)
+
+// ConflictKind describes how a prefix overlaps an existing entry.
+type ConflictKind int
+
+const (
+	// ConflictDuplicate means the existing entry has exactly the same prefix.
+	ConflictDuplicate ConflictKind = iota
+	// ConflictCovered means the existing entry is the closest one covering
+	// the prefix, and has a different value.
+	ConflictCovered
+	// ConflictCovering means the existing entry is more specific than the
+	// prefix and has a different value, so it overrides part of it.
+	ConflictCovering
+)
+
+func (k ConflictKind) String() string {
+	switch k {
+	case ConflictDuplicate:
+		return "duplicate"
+	case ConflictCovered:
+		return "covered"
+	case ConflictCovering:
+		return "covering"
+	}
+	return fmt.Sprintf("ConflictKind(%d)", int(k))
+}
+
+// Conflict reports a prefix and value overlapping an existing entry.
+type Conflict[V any] struct {
+	Kind     ConflictKind
+	Prefix   netip.Prefix
+	Value    V
+	Existing Entry[V]
+}
+
+func (c Conflict[V]) String() string {
+	var verb string
+	switch c.Kind {
+	case ConflictDuplicate:
+		verb = "duplicates"
+	case ConflictCovered:
+		verb = "is covered by"
+	case ConflictCovering:
+		verb = "covers"
+	default:
+		verb = "overlaps"
+	}
+	return fmt.Sprintf("%s=%v %s %s=%v", c.Prefix, c.Value, verb, c.Existing.Prefix, c.Existing.Value)
+}
+
+// Overlaps reports how storing v at prefix would interact with the entries
+// already in the tree: an entry at exactly prefix, the closest entry covering
+// prefix if its value differs, and every more specific entry whose value
+// differs. Values are compared with equal; a nil equal treats all values as
+// different. The tree is not changed.
+//
+// prefix is checked where the add methods would store it under the tree's
+// policies. A prefix they would reject overlaps nothing.
+func (i *Tree[V]) Overlaps(prefix netip.Prefix, v V, equal func(a, b V) bool) []Conflict[V] {
+	conflicts, _ := i.overlaps(prefix, v, equal)
+	return conflicts
+}
+
+func (i *Tree[V]) overlaps(prefix netip.Prefix, v V, equal func(a, b V) bool) ([]Conflict[V], error) {
+	if !prefix.IsValid() {
+		return nil, invalidPrefix(prefix.String(), nil)
+	}
+	// Only an add warns about host bits.
+	opts := i.opts
+	opts.hostBitsWarn = nil
+	prefix, err := opts.addPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	same := func(existing V) bool {
+		return equal != nil && equal(existing, v)
+	}
+
+	var conflicts []Conflict[V]
+	var closest *Entry[V]
+	i.coveringNodes(prefix, func(n *nradix.Node, match netip.Prefix) {
+		existing, ok := n.GetValue().(V)
+		if !ok {
+			return
+		}
+		if match.Bits() == prefix.Bits() {
+			conflicts = append(conflicts, Conflict[V]{Kind: ConflictDuplicate, Prefix: prefix, Value: v, Existing: Entry[V]{Prefix: match, Value: existing}})
+			return
+		}
+		closest = &Entry[V]{Prefix: match, Value: existing}
+	})
+	if closest != nil && !same(closest.Value) {
+		conflicts = append(conflicts, Conflict[V]{Kind: ConflictCovered, Prefix: prefix, Value: v, Existing: *closest})
+	}
+	_ = i.walkWithin(prefix, func(n *nradix.Node, match netip.Prefix) error {
+		if existing, ok := n.GetValue().(V); ok && match.Bits() != prefix.Bits() && !same(existing) {
+			conflicts = append(conflicts, Conflict[V]{Kind: ConflictCovering, Prefix: prefix, Value: v, Existing: Entry[V]{Prefix: match, Value: existing}})
+		}
+		return nil
+	})
+	return conflicts, nil
+}
+
+// OverlapsByString is Overlaps for a CIDR, bare address or range as accepted
+// by AddByString. A range is checked as the CIDRs it would be stored as, and
+// a zoned prefix against the entries of its zone under ZoneScoped. It returns
+// the error AddByString would for a prefix that cannot be stored.
+func (i *Tree[V]) OverlapsByString(ipcidr string, v V, equal func(a, b V) bool) ([]Conflict[V], error) {
+	if !isRange(ipcidr) {
+		prefix, zone, err := parseZoned(ipcidr)
+		if err != nil {
+			return nil, err
+		}
+		t := i.target(zone, false)
+		if t == nil {
+			// Nothing is scoped to the zone yet.
+			t = NewTree[V]()
+			t.opts = i.opts
+		}
+		return t.overlaps(prefix, v, equal)
+	}
+	from, to, err := parseRange(ipcidr)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := RangePrefixes(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []Conflict[V]
+	for _, prefix := range prefixes {
+		found, err := i.overlaps(prefix, v, equal)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, found...)
+	}
+	return conflicts, nil
+}
+
+// Conflicts reports every entry whose value differs from that of the closest
+// entry covering it, as a ConflictCovered conflict with the covering entry as
+// Existing, in address order. Values are compared with equal; a nil equal
+// treats all values as different, reporting every nested entry.
+func (i *Tree[V]) Conflicts(equal func(a, b V) bool) []Conflict[V] {
+	var conflicts []Conflict[V]
+	for _, family := range []netip.Prefix{allV4, allV6} {
+		// Entries arrive with covering prefixes first, so stack holds the
+		// chain of entries covering the current one.
+		var stack []Entry[V]
+		_ = i.WalkWithin(family, func(prefix netip.Prefix, v V) error {
+			for len(stack) > 0 && !stack[len(stack)-1].Prefix.Contains(prefix.Addr()) {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if equal == nil || !equal(top.Value, v) {
+					conflicts = append(conflicts, Conflict[V]{Kind: ConflictCovered, Prefix: prefix, Value: v, Existing: top})
+				}
+			}
+			stack = append(stack, Entry[V]{Prefix: prefix, Value: v})
+			return nil
+		})
+	}
+	return conflicts
+}
@@ -0,0 +1,126 @@
+package iptree
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func conflictStrings(conflicts []Conflict[int]) []string {
+	var result []string
+	for _, c := range conflicts {
+		result = append(result, c.String())
+	}
+	return result
+}
+
+func TestOverlaps(t *testing.T) {
+	ip := treeOf(t, map[string]int{
+		"10.0.0.0/8":     1,
+		"10.1.0.0/16":    2,
+		"10.1.2.0/24":    1,
+		"10.1.3.0/24":    3,
+		"2001:db8::/32":  4,
+		"2001:db8::/48":  4,
+		"192.168.0.0/16": 5,
+	})
+
+	tests := []struct {
+		cidr     string
+		v        int
+		expected []string
+	}{
+		{"10.1.0.0/16", 2, []string{"10.1.0.0/16=2 duplicates 10.1.0.0/16=2", "10.1.0.0/16=2 is covered by 10.0.0.0/8=1", "10.1.0.0/16=2 covers 10.1.2.0/24=1", "10.1.0.0/16=2 covers 10.1.3.0/24=3"}},
+		{"10.1.0.0/23", 2, []string{}},
+		{"10.1.0.0/23", 7, []string{"10.1.0.0/23=7 is covered by 10.1.0.0/16=2"}},
+		{"10.1.0.0/22", 1, []string{"10.1.0.0/22=1 is covered by 10.1.0.0/16=2", "10.1.0.0/22=1 covers 10.1.3.0/24=3"}},
+		{"172.16.0.0/12", 1, []string{}},
+		{"2001:db8::/40", 5, []string{"2001:db8::/40=5 is covered by 2001:db8::/32=4", "2001:db8::/40=5 covers 2001:db8::/48=4"}},
+		{"192.168.1.0-192.168.2.255", 5, []string{}},
+		{"192.168.1.0-192.168.2.255", 6, []string{"192.168.1.0/24=6 is covered by 192.168.0.0/16=5", "192.168.2.0/24=6 is covered by 192.168.0.0/16=5"}},
+	}
+	for _, test := range tests {
+		conflicts, err := ip.OverlapsByString(test.cidr, test.v, Equal[int])
+		if err != nil {
+			t.Errorf("OverlapsByString(%s) failed: %v", test.cidr, err)
+			continue
+		}
+		got := conflictStrings(conflicts)
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("OverlapsByString(%s=%d) returned %q, expected %q", test.cidr, test.v, got, test.expected)
+		}
+	}
+
+	// Without equal every overlap is reported.
+	conflicts := ip.Overlaps(netip.MustParsePrefix("2001:db8::/40"), 4, nil)
+	if len(conflicts) != 2 || conflicts[0].Kind != ConflictCovered || conflicts[1].Kind != ConflictCovering {
+		t.Errorf("Overlaps with nil equal returned %v", conflicts)
+	}
+	if _, err := ip.OverlapsByString("10.0.0.0/33", 1, nil); err == nil {
+		t.Error("Expected error for an invalid prefix")
+	}
+	if ip.Len() != 7 {
+		t.Error("Overlaps changed the tree")
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	ip := treeOf(t, map[string]int{
+		"10.0.0.0/8":    1,
+		"10.1.0.0/16":   2,
+		"10.1.2.0/24":   2,
+		"10.1.3.0/24":   1,
+		"10.2.0.0/16":   1,
+		"11.0.0.0/8":    3,
+		"2001:db8::/32": 4,
+		"2001:db8::/48": 5,
+	})
+	got := conflictStrings(ip.Conflicts(Equal[int]))
+	expected := []string{
+		"10.1.0.0/16=2 is covered by 10.0.0.0/8=1",
+		"10.1.3.0/24=1 is covered by 10.1.0.0/16=2",
+		"2001:db8::/48=5 is covered by 2001:db8::/32=4",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Conflicts returned %q, expected %q", got, expected)
+	}
+	if got := ip.Conflicts(nil); len(got) != 5 {
+		t.Errorf("Conflicts with nil equal returned %d conflicts, expected 5", len(got))
+	}
+}
+
+func TestOverlapsPolicies(t *testing.T) {
+	ip := NewTree[int]()
+	ip.SetMappedPolicy(MappedKeep)
+	ip.AddByString("10.0.0.0/8", 1)
+	mapped := netip.MustParsePrefix("::ffff:10.0.0.0/104")
+	if conflicts := ip.Overlaps(mapped, 2, nil); len(conflicts) != 0 {
+		t.Errorf("Overlaps of a mapped prefix under MappedKeep returned %v", conflicts)
+	}
+	if _, err := ip.OverlapsByString(mapped.String(), 2, nil); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Expected ErrInvalidPrefix as from AddByString, got %v", err)
+	}
+
+	warned := false
+	ip.SetHostBitsPolicy(HostBitsWarn, func(given, masked netip.Prefix) { warned = true })
+	if conflicts := ip.Overlaps(netip.MustParsePrefix("10.1.2.3/16"), 2, nil); len(conflicts) != 1 || warned {
+		t.Errorf("Overlaps under HostBitsWarn returned %v and warned %v", conflicts, warned)
+	}
+	ip.SetHostBitsPolicy(HostBitsReject, nil)
+	if _, err := ip.OverlapsByString("10.1.2.3/16", 2, nil); !errors.Is(err, ErrHostBitsSet) {
+		t.Errorf("Expected ErrHostBitsSet, got %v", err)
+	}
+
+	ip = NewTree[int]()
+	ip.SetZonePolicy(ZoneScoped)
+	ip.AddByString("fe80::/10", 1)
+	ip.AddByString("fe80::%eth0/64", 2)
+	conflicts, err := ip.OverlapsByString("fe80::%eth0/64", 3, nil)
+	if got := conflictStrings(conflicts); err != nil || !slices.Equal(got, []string{"fe80::/64=3 duplicates fe80::/64=2"}) {
+		t.Errorf("OverlapsByString in a zone returned %q, %v", got, err)
+	}
+	if conflicts, err := ip.OverlapsByString("fe80::%eth1/64", 3, nil); err != nil || len(conflicts) != 0 {
+		t.Errorf("OverlapsByString in an empty zone returned %v, %v", conflicts, err)
+	}
+}
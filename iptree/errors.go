@@ -0,0 +1,75 @@
+package iptree
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/iqhive/nradix"
+)
+
+var (
+	// ErrInvalidPrefix is returned for a malformed CIDR, address or mask.
+	// Errors matching it also match nradix.ErrBadIP, which was returned
+	// before it, for now.
+	ErrInvalidPrefix = errors.New("iptree: invalid prefix")
+	// ErrInvalidRange is returned for a malformed address range, or one whose
+	// ends are of different families or out of order.
+	ErrInvalidRange = errors.New("iptree: invalid range")
+	// ErrHostBitsSet is returned for a prefix with bits set beyond its mask,
+	// such as 10.1.2.3/8, where only a masked prefix is accepted.
+	ErrHostBitsSet = errors.New("iptree: prefix has host bits set")
+	// ErrExists is returned when adding, without overwriting, a prefix that
+	// is already in the tree. Errors matching it also match
+	// nradix.ErrNodeBusy, which was returned before it, for now.
+	ErrExists = errors.New("iptree: prefix already exists")
+	// ErrNotFound is returned when deleting a prefix that is not in the tree.
+	// Errors matching it also match nradix.ErrNotFound, which was returned
+	// before it, for now.
+	ErrNotFound = errors.New("iptree: prefix not found")
+)
+
+// PrefixError records the operation and input that caused an error. Err is
+// usually one of the errors above, so callers can test it with errors.Is.
+type PrefixError struct {
+	Op    string // the step that failed: "parse", "range", "add", "delete"
+	Input string // the prefix, address or range the step was given
+	Err   error
+
+	cause  error // the parse error behind Err, if any
+	legacy error // the nradix error returned before Err existed, if any
+}
+
+func (e *PrefixError) Error() string {
+	msg := e.Op + " " + strconv.Quote(e.Input) + ": " + e.Err.Error()
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e *PrefixError) Unwrap() []error {
+	errs := []error{e.Err}
+	if e.cause != nil {
+		errs = append(errs, e.cause)
+	}
+	if e.legacy != nil {
+		errs = append(errs, e.legacy)
+	}
+	return errs
+}
+
+// invalidPrefix returns the error for input that does not form a prefix.
+func invalidPrefix(input string, cause error) error {
+	return &PrefixError{Op: "parse", Input: input, Err: ErrInvalidPrefix, cause: cause, legacy: nradix.ErrBadIP}
+}
+
+// exists returns the error for adding input without overwriting the entry
+// already there.
+func exists(input string) error {
+	return &PrefixError{Op: "add", Input: input, Err: ErrExists, legacy: nradix.ErrNodeBusy}
+}
+
+// notFound returns the error for deleting input when there is no entry there.
+func notFound(input string) error {
+	return &PrefixError{Op: "delete", Input: input, Err: ErrNotFound, legacy: nradix.ErrNotFound}
+}
@@ -0,0 +1,522 @@
+package iptree
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/iqhive/nradix"
+)
+
+// FrozenTree is a read-only copy of a Tree compiled for fast lookups, made by
+// Tree.Freeze. It answers the Get family of methods as the Tree did when it
+// was frozen, under the same policies, and is safe for concurrent use.
+//
+// The entries are compiled into a multibit trie in the style of Poptrie. Each
+// node consumes six bits of the address and holds two 64-bit bitmaps: one
+// marking which of its 64 slots continue in a child node, and one marking
+// where runs of slots with the same longest match begin. The children and
+// leaves of a node are stored contiguously in two flat arrays and found by
+// counting bits, so a lookup reads one 24 byte node per six bits of address
+// and allocates nothing.
+type FrozenTree[V any] struct {
+	nodes   []fnode
+	leaves  []uint32
+	entries []fentry[V]
+	v4, v6  uint32 // root nodes of each family
+	v4Len   int
+	v6Len   int
+	opts    options
+	zones   map[string]*FrozenTree[V]
+}
+
+// fnode is a node of a FrozenTree. Slot s continues in a child if bit s of vec
+// is set, and otherwise ends in the leaf found by counting the bits of leafvec
+// up to s.
+type fnode struct {
+	vec, leafvec     uint64
+	leaves, children uint32 // index of the first leaf and child
+}
+
+// fentry is an entry of a FrozenTree. Leaves refer to entries by index, with
+// index 0 meaning no entry.
+type fentry[V any] struct {
+	Entry[V]
+	parent uint32 // the longest entry of the same family covering this one
+	depth  uint8  // depth of the entry in the underlying tree
+}
+
+// stride is the number of address bits each node of a FrozenTree consumes.
+const stride = 6
+
+// Freeze compiles the tree into a FrozenTree. Later changes to the tree do not
+// affect the FrozenTree, but values holding pointers are shared with it.
+func (i *Tree[V]) Freeze() *FrozenTree[V] {
+	f := &FrozenTree[V]{
+		entries: make([]fentry[V], 1, i.v4Len+i.v6Len+1),
+		v4Len:   i.v4Len,
+		v6Len:   i.v6Len,
+		opts:    i.opts,
+	}
+	// Entries are numbered in address order, which GetAllWithin relies on.
+	index := make(map[*nradix.Node]uint32, i.v4Len+i.v6Len)
+	collect := func(n *nradix.Node, prefix netip.Prefix) error {
+		if v, ok := n.GetValue().(V); ok {
+			_, depth := treeKey(prefix)
+			index[n] = uint32(len(f.entries))
+			f.entries = append(f.entries, fentry[V]{Entry: Entry[V]{Prefix: prefix, Value: v}, depth: uint8(depth)})
+		}
+		return nil
+	}
+	_ = i.walkWithin(allV4, collect)
+	_ = i.walkWithin(allV6, collect)
+
+	c := &freezer[V]{f: f, index: index}
+	v4, _ := i.start(true)
+	f.v4 = c.root(v4, v4Key, v4Depth, true)
+	f.v6 = c.root(i.root(), [16]byte{}, 0, false)
+
+	for name, z := range i.zones {
+		if z.Len() == 0 {
+			continue
+		}
+		if f.zones == nil {
+			f.zones = make(map[string]*FrozenTree[V])
+		}
+		f.zones[name] = z.Freeze()
+	}
+	return f
+}
+
+// freezer compiles the nodes of a Tree into a FrozenTree.
+type freezer[V any] struct {
+	f     *FrozenTree[V]
+	index map[*nradix.Node]uint32 // entry of every node holding one
+}
+
+// root compiles the trie of one family, starting with n at depth along key,
+// and returns its root node.
+func (c *freezer[V]) root(n *nradix.Node, key [16]byte, depth int, is4 bool) uint32 {
+	at := uint32(len(c.f.nodes))
+	c.f.nodes = append(c.f.nodes, fnode{})
+	c.node(at, n, key, depth, is4, 0)
+	return at
+}
+
+// node compiles the levels of the underlying tree from depth to depth+stride,
+// starting with n at depth along key, into nodes[at]. n may be nil, and best
+// is the longest entry covering it.
+func (c *freezer[V]) node(at uint32, n *nradix.Node, key [16]byte, depth int, is4 bool, best uint32) {
+	// slots holds where each slot of the node ends: in a child node if n is
+	// set, otherwise in a leaf holding best.
+	var slots [1 << stride]struct {
+		n    *nradix.Node
+		key  [16]byte
+		best uint32
+	}
+	var fill func(n *nradix.Node, key [16]byte, d, slot int, best uint32)
+	fill = func(n *nradix.Node, key [16]byte, d, slot int, best uint32) {
+		if d == depth+stride {
+			if n != nil && (n.GetValue() != nil || hasChildren(n)) {
+				slots[slot].n, slots[slot].key = n, key
+			}
+			slots[slot].best = best
+			return
+		}
+		if n != nil && n.GetValue() != nil {
+			if e, ok := c.index[n]; ok {
+				c.f.entries[e].parent = best
+				best = e
+			}
+		}
+		width := 1 << (depth + stride - d)
+		if n == nil || d == 128 {
+			for k := slot; k < slot+width; k++ {
+				slots[k].best = best
+			}
+			return
+		}
+		mask := byte(0x80 >> (d % 8))
+		key[d/8] &^= mask
+		fill(trieChild(n.GetLeft(), &key, d+1, is4), key, d+1, slot, best)
+		key[d/8] |= mask
+		fill(trieChild(n.GetRight(), &key, d+1, is4), key, d+1, slot+width/2, best)
+	}
+	fill(n, key, depth, 0, best)
+
+	node := fnode{leaves: uint32(len(c.f.leaves)), children: uint32(len(c.f.nodes))}
+	for slot, s := range slots {
+		if s.n != nil {
+			node.vec |= 1 << slot
+			continue
+		}
+		if node.leafvec == 0 || c.f.leaves[len(c.f.leaves)-1] != s.best {
+			node.leafvec |= 1 << slot
+			c.f.leaves = append(c.f.leaves, s.best)
+		}
+	}
+	c.f.nodes = append(c.f.nodes, make([]fnode, bits.OnesCount64(node.vec))...)
+	c.f.nodes[at] = node
+	next := node.children
+	for _, s := range slots {
+		if s.n != nil {
+			c.node(next, s.n, s.key, depth+stride, is4, s.best)
+			next++
+		}
+	}
+}
+
+// trieChild returns n, a node at depth along key, or nil if it belongs to the
+// trie of the other family.
+func trieChild(n *nradix.Node, key *[16]byte, depth int, is4 bool) *nradix.Node {
+	if !is4 && depth == v4Depth && isV4Space(key) {
+		// The IPv4 entries have a trie of their own.
+		return nil
+	}
+	return n
+}
+
+// search returns the longest entry covering the address hi:lo in the trie
+// whose root node starts at depth.
+func (f *FrozenTree[V]) search(root uint32, depth int, hi, lo uint64) uint32 {
+	n := &f.nodes[root]
+	for d := uint(depth); ; d += stride {
+		var chunk uint64
+		if d < 64 {
+			chunk = hi<<d | lo>>(64-d)
+		} else {
+			chunk = lo << (d - 64)
+		}
+		bit := uint64(1) << (chunk >> (64 - stride))
+		upTo := bit<<1 - 1
+		if n.vec&bit == 0 {
+			return f.leaves[n.leaves+uint32(bits.OnesCount64(n.leafvec&upTo))-1]
+		}
+		n = &f.nodes[n.children+uint32(bits.OnesCount64(n.vec&upTo))-1]
+	}
+}
+
+// addrKey returns the key of addr in the underlying tree as two halves.
+func addrKey(addr netip.Addr) (hi, lo uint64) {
+	if addr.Is4() {
+		a := addr.As4()
+		return 0, 0xffff<<32 | uint64(binary.BigEndian.Uint32(a[:]))
+	}
+	a := addr.As16()
+	return binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(a[8:])
+}
+
+// cover returns e, or the closest entry covering it, that is no deeper than
+// depth.
+func (f *FrozenTree[V]) cover(e uint32, depth int) uint32 {
+	for e != 0 && int(f.entries[e].depth) > depth {
+		e = f.entries[e].parent
+	}
+	return e
+}
+
+// matches returns the longest IPv4 and IPv6 entries covering prefix under the
+// mapped policy, either of which may be 0. Only mapped prefixes can match
+// entries of both families, and their IPv4 matches are the longer ones.
+func (f *FrozenTree[V]) matches(prefix netip.Prefix) (v4, v6 uint32) {
+	prefix = f.opts.lookupPrefix(prefix)
+	hi, lo := addrKey(prefix.Addr())
+	depth := prefix.Bits()
+	is4 := prefix.Addr().Is4()
+	if is4 {
+		depth += v4Depth
+	}
+	if is4 || depth >= v4Depth && hi == 0 && lo>>32 == 0xffff {
+		v4 = f.cover(f.search(f.v4, v4Depth, hi, lo), depth)
+	}
+	if !is4 {
+		v6 = f.cover(f.search(f.v6, 0, hi, lo), depth)
+	}
+	return v4, v6
+}
+
+// lookup returns the longest entry covering prefix, or nil.
+func (f *FrozenTree[V]) lookup(prefix netip.Prefix, zone string) *fentry[V] {
+	if z := f.scope(zone); z != nil {
+		if e := z.lookup(prefix, ""); e != nil {
+			return e
+		}
+	}
+	v4, v6 := f.matches(prefix)
+	if v4 != 0 {
+		return &f.entries[v4]
+	}
+	if v6 != 0 {
+		return &f.entries[v6]
+	}
+	return nil
+}
+
+// scope returns the tree zone-scoped lookups of zone should try before f, or
+// nil if there is none.
+func (f *FrozenTree[V]) scope(zone string) *FrozenTree[V] {
+	if zone == "" || f.opts.zone != ZoneScoped {
+		return nil
+	}
+	return f.zones[zone]
+}
+
+// Len returns the number of entries in the tree.
+func (f *FrozenTree[V]) Len() int {
+	return f.v4Len + f.LenV6()
+}
+
+// LenV4 returns the number of IPv4 entries in the tree.
+func (f *FrozenTree[V]) LenV4() int {
+	return f.v4Len
+}
+
+// LenV6 returns the number of IPv6 entries in the tree.
+func (f *FrozenTree[V]) LenV6() int {
+	n := f.v6Len
+	for _, z := range f.zones {
+		n += z.Len()
+	}
+	return n
+}
+
+// Zone returns the tree holding the entries scoped to zone, or nil if there
+// are none.
+func (f *FrozenTree[V]) Zone(zone string) *FrozenTree[V] {
+	return f.zones[zone]
+}
+
+// Zones returns the names of the zones holding entries, sorted.
+func (f *FrozenTree[V]) Zones() []string {
+	var names []string
+	for name := range f.zones {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (f *FrozenTree[V]) Get(ip net.IP) (V, bool, error) {
+	return f.GetNetIP(ip)
+}
+
+func (f *FrozenTree[V]) GetByString(ipstr string) (V, bool, error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return f.get(prefix, zone)
+}
+
+func (f *FrozenTree[V]) GetIPNet(ip net.IPNet) (V, bool, error) {
+	prefix, err := ipNetLookup(ip)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return f.get(prefix, "")
+}
+
+func (f *FrozenTree[V]) GetNetIP(ip net.IP) (V, bool, error) {
+	nip, err := netIPAddr(ip)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return f.get(netip.PrefixFrom(nip, nip.BitLen()), "")
+}
+
+func (f *FrozenTree[V]) GetNetIPAddr(nip netip.Addr) (V, bool, error) {
+	if !nip.IsValid() {
+		var zero V
+		return zero, false, invalidPrefix(nip.String(), nil)
+	}
+	return f.get(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+func (f *FrozenTree[V]) get(prefix netip.Prefix, zone string) (V, bool, error) {
+	e := f.lookup(prefix, zone)
+	if e == nil {
+		var zero V
+		return zero, false, nil
+	}
+	return e.Value, true, nil
+}
+
+// GetBatch looks up every address of addrs as Tree.GetBatch does.
+func (f *FrozenTree[V]) GetBatch(addrs []netip.Addr, out []V, found []bool) {
+	_, _ = out[:len(addrs)], found[:len(addrs)]
+	for k, addr := range addrs {
+		out[k], found[k], _ = f.GetNetIPAddr(addr)
+	}
+}
+
+// GetWithPrefixByString returns the value of the longest prefix covering the
+// given address or CIDR, along with that prefix.
+func (f *FrozenTree[V]) GetWithPrefixByString(ipstr string) (V, netip.Prefix, bool, error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	return f.getWithPrefix(prefix, zone)
+}
+
+// GetWithPrefixNetIP returns the value of the longest prefix covering ip,
+// along with that prefix.
+func (f *FrozenTree[V]) GetWithPrefixNetIP(ip net.IP) (V, netip.Prefix, bool, error) {
+	nip, err := netIPAddr(ip)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	return f.GetWithPrefixNetIPAddr(nip)
+}
+
+// GetWithPrefixNetIPAddr returns the value of the longest prefix covering nip,
+// along with that prefix.
+func (f *FrozenTree[V]) GetWithPrefixNetIPAddr(nip netip.Addr) (V, netip.Prefix, bool, error) {
+	if !nip.IsValid() {
+		var zero V
+		return zero, netip.Prefix{}, false, invalidPrefix(nip.String(), nil)
+	}
+	return f.getWithPrefix(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+func (f *FrozenTree[V]) getWithPrefix(prefix netip.Prefix, zone string) (V, netip.Prefix, bool, error) {
+	e := f.lookup(prefix, zone)
+	if e == nil {
+		var zero V
+		return zero, netip.Prefix{}, false, nil
+	}
+	return e.Value, e.Prefix, true, nil
+}
+
+// GetAllMatches returns every entry whose prefix contains nip, ordered from
+// the most to the least specific.
+func (f *FrozenTree[V]) GetAllMatches(nip netip.Addr) []Entry[V] {
+	if !nip.IsValid() {
+		return nil
+	}
+	return f.allMatches(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+// GetAllMatchesByString returns every entry whose prefix contains the given
+// address or CIDR, ordered from the most to the least specific.
+func (f *FrozenTree[V]) GetAllMatchesByString(ipstr string) ([]Entry[V], error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		return nil, err
+	}
+	return f.allMatches(prefix, zone), nil
+}
+
+func (f *FrozenTree[V]) allMatches(prefix netip.Prefix, zone string) []Entry[V] {
+	var matches []Entry[V]
+	if z := f.scope(zone); z != nil {
+		// Zone entries come first, as in Tree.allMatches.
+		matches = z.allMatches(prefix, "")
+	}
+	v4, v6 := f.matches(prefix)
+	for _, e := range []uint32{v4, v6} {
+		for ; e != 0; e = f.entries[e].parent {
+			matches = append(matches, f.entries[e].Entry)
+		}
+	}
+	return matches
+}
+
+// GetExact returns the value stored for exactly prefix. Unlike the Get
+// family it does not fall back to a covering prefix.
+func (f *FrozenTree[V]) GetExact(prefix netip.Prefix) (V, bool) {
+	prefix, ok := f.opts.entryPrefix(prefix)
+	if !prefix.IsValid() || !ok {
+		var zero V
+		return zero, false
+	}
+	e := f.lookup(prefix, "")
+	if e == nil || e.Prefix != prefix {
+		var zero V
+		return zero, false
+	}
+	return e.Value, true
+}
+
+// GetExactByString returns the value stored for exactly the given CIDR. A bare
+// address is treated as a host prefix.
+func (f *FrozenTree[V]) GetExactByString(ipcidr string) (V, bool, error) {
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	t := f
+	if zone != "" && f.opts.zone == ZoneScoped {
+		if t = f.zones[zone]; t == nil {
+			var zero V
+			return zero, false, nil
+		}
+	}
+	v, found := t.GetExact(prefix)
+	return v, found, nil
+}
+
+// GetExactIPNet returns the value stored for exactly cidr.
+func (f *FrozenTree[V]) GetExactIPNet(cidr *net.IPNet) (V, bool, error) {
+	prefix, err := cidrPrefix(cidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	v, found := f.GetExact(prefix)
+	return v, found, nil
+}
+
+// HasPrefix reports whether exactly prefix is in the tree.
+func (f *FrozenTree[V]) HasPrefix(prefix netip.Prefix) bool {
+	_, found := f.GetExact(prefix)
+	return found
+}
+
+// HasPrefixByString reports whether exactly the given CIDR is in the tree.
+func (f *FrozenTree[V]) HasPrefixByString(ipcidr string) (bool, error) {
+	_, found, err := f.GetExactByString(ipcidr)
+	return found, err
+}
+
+// HasPrefixIPNet reports whether exactly cidr is in the tree.
+func (f *FrozenTree[V]) HasPrefixIPNet(cidr *net.IPNet) (bool, error) {
+	_, found, err := f.GetExactIPNet(cidr)
+	return found, err
+}
+
+// GetAll returns all entries in the tree as a map of CIDR strings to their
+// values.
+func (f *FrozenTree[V]) GetAll() map[string]V {
+	result := make(map[string]V, len(f.entries)-1)
+	for _, e := range f.entries[1:] {
+		result[e.Prefix.String()] = e.Value
+	}
+	return result
+}
+
+// GetAllWithin returns every entry whose prefix is equal to or more specific
+// than prefix, in address order.
+func (f *FrozenTree[V]) GetAllWithin(prefix netip.Prefix) []Entry[V] {
+	prefix, ok := f.opts.entryPrefix(prefix)
+	if !prefix.IsValid() || !ok {
+		return nil
+	}
+	entries := f.entries[1:]
+	k, _ := slices.BinarySearchFunc(entries, prefix, func(e fentry[V], p netip.Prefix) int {
+		return comparePrefixes(e.Prefix, p)
+	})
+	var result []Entry[V]
+	for ; k < len(entries) && prefix.Contains(entries[k].Prefix.Addr()); k++ {
+		result = append(result, entries[k].Entry)
+	}
+	return result
+}
@@ -0,0 +1,131 @@
+package iptree
+
+import (
+	"maps"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// frozenAddrs returns n addresses near the prefixes of list, in all the forms
+// a lookup can take.
+func frozenAddrs(list []string, n int) []netip.Addr {
+	r := rand.New(rand.NewSource(2))
+	addrs := make([]netip.Addr, 0, n)
+	for len(addrs) < n {
+		prefix := netip.MustParsePrefix(list[r.Intn(len(list))])
+		a := prefix.Addr().As16()
+		for k := r.Intn(17); k < 16; k++ {
+			a[k] ^= byte(r.Intn(256))
+		}
+		addr := netip.AddrFrom16(a)
+		if prefix.Addr().Is4() && r.Intn(4) != 0 {
+			// Otherwise left IPv4-mapped.
+			addr = addr.Unmap()
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestFreeze(t *testing.T) {
+	list := append(largeList(2000), strs...)
+	list = append(list, "::/0", "::/1", "::ffff:0:0/80", "::ffff:0:0/95", "2001:db8::/32", "0.0.0.0/0")
+
+	r := rand.New(rand.NewSource(3))
+	for _, policy := range []MappedPolicy{MappedMatchBoth, MappedUnmap, MappedKeep} {
+		tree := NewTree[int]()
+		tree.SetMappedPolicy(policy)
+		for k, s := range list {
+			tree.AddByString(s, k)
+		}
+		frozen := tree.Freeze()
+
+		if frozen.Len() != tree.Len() || frozen.LenV4() != tree.LenV4() {
+			t.Errorf("Policy %d: frozen tree has %d entries, expected %d", policy, frozen.Len(), tree.Len())
+		}
+		if !maps.Equal(frozen.GetAll(), tree.GetAll()) {
+			t.Errorf("Policy %d: GetAll differs from the tree", policy)
+		}
+
+		for _, addr := range frozenAddrs(list, 20000) {
+			val, prefix, found, _ := frozen.GetWithPrefixNetIPAddr(addr)
+			expVal, expPrefix, expFound, _ := tree.GetWithPrefixNetIPAddr(addr)
+			if val != expVal || prefix != expPrefix || found != expFound {
+				t.Fatalf("Policy %d: lookup of %s returned %d from %s, expected %d from %s",
+					policy, addr, val, prefix, expVal, expPrefix)
+			}
+			if matches, exp := frozen.GetAllMatches(addr), tree.GetAllMatches(addr); !reflect.DeepEqual(matches, exp) {
+				t.Fatalf("Policy %d: matches of %s are %v, expected %v", policy, addr, matches, exp)
+			}
+			cidr := netip.PrefixFrom(addr, r.Intn(addr.BitLen()+1)).String()
+			val, found, _ = frozen.GetByString(cidr)
+			expVal, expFound, _ = tree.GetByString(cidr)
+			if val != expVal || found != expFound {
+				t.Fatalf("Policy %d: lookup of %s returned %d, expected %d", policy, cidr, val, expVal)
+			}
+		}
+
+		for _, s := range list {
+			prefix := netip.MustParsePrefix(s)
+			val, found := frozen.GetExact(prefix)
+			expVal, expFound := tree.GetExact(prefix)
+			if val != expVal || found != expFound {
+				t.Fatalf("Policy %d: GetExact(%s) returned %d, expected %d", policy, s, val, expVal)
+			}
+		}
+		for _, s := range []string{"0.0.0.0/0", "10.0.0.0/8", "128.0.0.0/2", "::/0", "::ffff:0:0/96", "2001:db8::/32", "2000::/3"} {
+			prefix := netip.MustParsePrefix(s)
+			if within, exp := frozen.GetAllWithin(prefix), tree.GetAllWithin(prefix); !reflect.DeepEqual(within, exp) {
+				t.Errorf("Policy %d: GetAllWithin(%s) returned %d entries, expected %d", policy, s, len(within), len(exp))
+			}
+		}
+	}
+}
+
+func TestFreezeEmpty(t *testing.T) {
+	frozen := NewTree[int]().Freeze()
+	if _, found, err := frozen.GetByString("1.2.3.4"); found || err != nil {
+		t.Errorf("Empty frozen tree found an entry: %v", err)
+	}
+	if _, found, err := frozen.GetByString("2001:db8::1"); found || err != nil {
+		t.Errorf("Empty frozen tree found an entry: %v", err)
+	}
+	if _, _, err := frozen.GetByString("1.2.3"); err == nil {
+		t.Error("Expected error looking up an invalid address")
+	}
+}
+
+func TestFreezeZones(t *testing.T) {
+	tree := NewTree[int]()
+	tree.SetZonePolicy(ZoneScoped)
+	tree.AddByString("fe80::/10", 1)
+	tree.AddByString("fe80::%eth0/64", 2)
+	tree.AddByString("fe80::1%eth1", 3)
+	frozen := tree.Freeze()
+
+	for _, s := range []string{"fe80::1", "fe80::1%eth0", "fe80::1%eth1", "fe80::2%eth1", "fe80::1%eth2"} {
+		val, _, _ := frozen.GetByString(s)
+		if exp, _, _ := tree.GetByString(s); val != exp {
+			t.Errorf("Lookup of %s returned %d, expected %d", s, val, exp)
+		}
+	}
+	if val, found, _ := frozen.GetExactByString("fe80::%eth0/64"); val != 2 || !found {
+		t.Errorf("GetExactByString returned %d, %v", val, found)
+	}
+	if found, _ := frozen.HasPrefixByString("fe80::/64"); found {
+		t.Error("Zone-scoped entry found without its zone")
+	}
+	if matches, _ := frozen.GetAllMatchesByString("fe80::1%eth0"); len(matches) != 2 || matches[0].Value != 2 {
+		t.Errorf("GetAllMatchesByString returned %v", matches)
+	}
+	if frozen.Len() != 3 || !reflect.DeepEqual(frozen.Zones(), []string{"eth0", "eth1"}) {
+		t.Errorf("Frozen tree has %d entries in zones %v", frozen.Len(), frozen.Zones())
+	}
+
+	tree.AddByString("fe80::/16", 4)
+	if val, _, _ := frozen.GetByString("fe80::1"); val != 1 {
+		t.Error("Change to the tree showed in the frozen tree")
+	}
+}
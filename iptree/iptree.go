@@ -17,101 +17,688 @@ package iptree
 import (
 	"net"
 	"net/netip"
+	"slices"
+	"strconv"
 
 	"github.com/iqhive/nradix"
 )
 
-type IPTree struct {
+// Tree is a prefix tree mapping IPv4 and IPv6 subnets to values of type V.
+// Values are stored boxed in the underlying nradix tree, which treats a nil
+// interface as "no entry", so a nil value of an interface type V cannot be
+// stored.
+//
+// R is the underlying tree. Changes made directly through R bypass the
+// bookkeeping Tree does, so it should only be used for reads.
+type Tree[V any] struct {
 	R *nradix.Tree
+
+	top   *nradix.Node
+	v4    *nradix.Node
+	v4Len int
+	v6Len int
+	opts  options
+	zones map[string]*Tree[V]
+
+	snap   *PersistentTree[V] // kept up to date once Snapshot is called
+	parent *Tree[V]           // the tree holding this one as zone name
+	name   string
+}
+
+// Entry is a prefix stored in a Tree together with its value.
+type Entry[V any] struct {
+	Prefix netip.Prefix
+	Value  V
 }
 
+// IPTree is the untyped tree used before Tree became generic. It is kept so
+// existing callers continue to compile unchanged.
+type IPTree = Tree[any]
+
 func ipToUint(ip net.IP) uint32 {
 	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
 }
 
+// New returns an empty untyped IPTree.
 func New() *IPTree {
-	t := new(IPTree)
+	return NewTree[any]()
+}
+
+// NewTree returns an empty Tree holding values of type V.
+func NewTree[V any]() *Tree[V] {
+	t := new(Tree[V])
 	t.R = nradix.NewTree(0)
+	t.top = t.root()
+	t.refreshV4()
 	return t
 }
 
-func (i *IPTree) Add(cidr *net.IPNet, v interface{}) error {
-	return i.R.SetCIDRString(cidr.String(), v, true)
+// typed converts a raw value returned by the underlying tree into V,
+// reporting whether an entry of that type was present.
+func typed[V any](raw interface{}, err error) (V, bool, error) {
+	if raw != nil {
+		if v, ok := raw.(V); ok {
+			return v, true, err
+		}
+	}
+	var zero V
+	return zero, false, err
 }
 
-func (i *IPTree) AddByString(ipcidr string, v interface{}) error {
-	return i.R.SetCIDRString(ipcidr, v, true)
+func (i *Tree[V]) Add(cidr *net.IPNet, v V) error {
+	return i.add(cidr, v, true)
 }
 
-func (i *IPTree) AddByNetIP(ipcidr net.IP, mask net.IPMask, v interface{}) error {
-	return i.R.SetCIDRNetIP(ipcidr, mask, v, true)
+// AddIfAbsent is Add without overwriting: if cidr is already in the tree the
+// entry is left alone and ErrExists is returned.
+func (i *Tree[V]) AddIfAbsent(cidr *net.IPNet, v V) error {
+	return i.add(cidr, v, false)
 }
 
-func (i *IPTree) AddByNetIPAddr(ipcidr netip.Addr, mask netip.Prefix, v interface{}, overwrite bool) error {
-	return i.R.SetCIDRNetIPAddr(ipcidr, mask, v, overwrite)
+func (i *Tree[V]) add(cidr *net.IPNet, v V, overwrite bool) error {
+	prefix, err := cidrPrefix(cidr)
+	if err != nil {
+		return err
+	}
+	return i.set(prefix, v, overwrite)
 }
 
-func (i *IPTree) Get(ip net.IP) (interface{}, bool, error) {
-	v, err := i.R.FindCIDRString(ip.String())
-	if v != nil {
-		return v, true, err
-	} else {
-		return v, false, err
+// AddByString stores v at the given CIDR or bare address. A range written as
+// first-last, such as 1.2.3.4-1.2.5.17, is stored as the CIDRs covering it.
+func (i *Tree[V]) AddByString(ipcidr string, v V) error {
+	return i.addString(ipcidr, v, true)
+}
+
+// AddByStringIfAbsent is AddByString without overwriting: if the CIDR, or any
+// CIDR of a range, is already in the tree nothing is added and ErrExists is
+// returned.
+func (i *Tree[V]) AddByStringIfAbsent(ipcidr string, v V) error {
+	return i.addString(ipcidr, v, false)
+}
+
+func (i *Tree[V]) addString(ipcidr string, v V, overwrite bool) error {
+	if isRange(ipcidr) {
+		from, to, err := parseRange(ipcidr)
+		if err != nil {
+			return err
+		}
+		return i.addRange(from, to, v, overwrite)
+	}
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		return err
 	}
+	return i.target(zone, true).set(prefix, v, overwrite)
 }
 
-func (i *IPTree) GetByString(ipstr string) (interface{}, bool, error) {
-	v, err := i.R.FindCIDRString(ipstr)
-	if v != nil {
-		return v, true, err
-	} else {
-		return v, false, err
+func (i *Tree[V]) AddByNetIP(ipcidr net.IP, mask net.IPMask, v V) error {
+	return i.addNetIP(ipcidr, mask, v, true)
+}
+
+// AddByNetIPIfAbsent is AddByNetIP without overwriting: if the prefix is
+// already in the tree the entry is left alone and ErrExists is returned.
+func (i *Tree[V]) AddByNetIPIfAbsent(ipcidr net.IP, mask net.IPMask, v V) error {
+	return i.addNetIP(ipcidr, mask, v, false)
+}
+
+func (i *Tree[V]) addNetIP(ipcidr net.IP, mask net.IPMask, v V, overwrite bool) error {
+	prefix, err := ipNetPrefix(ipcidr, mask)
+	if err != nil {
+		return err
 	}
+	return i.set(prefix, v, overwrite)
 }
 
-func (i *IPTree) GetIPNet(ip net.IPNet) (interface{}, bool, error) {
-	v, err := i.R.FindCIDRIPNet(ip)
-	if v != nil {
-		return v, true, err
-	} else {
-		return v, false, err
+func (i *Tree[V]) AddByNetIPAddr(ipcidr netip.Addr, mask netip.Prefix, v V, overwrite bool) error {
+	prefix := netip.PrefixFrom(ipcidr, mask.Bits())
+	if !prefix.IsValid() {
+		return invalidPrefix(ipcidr.String()+"/"+strconv.Itoa(mask.Bits()), nil)
 	}
+	return i.target(ipcidr.Zone(), true).set(prefix, v, overwrite)
 }
 
-func (i *IPTree) GetNetIP(ip net.IP) (interface{}, bool, error) {
-	v, err := i.R.FindCIDRNetIP(ip)
-	if v != nil {
-		return v, true, err
-	} else {
-		return v, false, err
+// set stores v at prefix, keeping the entry counts and the tracked IPv4 node
+// up to date. Without overwrite an existing entry is left alone and ErrExists
+// is returned.
+func (i *Tree[V]) set(prefix netip.Prefix, v V, overwrite bool) error {
+	prefix, err := i.addPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	n := i.exactNode(prefix)
+	if !overwrite && n != nil && n.GetValue() != nil {
+		return exists(prefix.String())
+	}
+	return i.store(prefix, n, v)
+}
+
+// Upsert stores at prefix the value fn returns when given the value already
+// stored there, or the zero value and false if there is none. An existing
+// entry is updated with a single descent of the tree, rather than the two a
+// GetExact followed by an add would take.
+func (i *Tree[V]) Upsert(prefix netip.Prefix, fn func(old V, exists bool) V) error {
+	if !prefix.IsValid() {
+		return invalidPrefix(prefix.String(), nil)
+	}
+	prefix, err := i.addPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	n := i.exactNode(prefix)
+	var old V
+	var exists bool
+	if n != nil {
+		old, exists, _ = typed[V](n.GetValue(), nil)
+	}
+	return i.store(prefix, n, fn(old, exists))
+}
+
+// UpsertByString is Upsert for a CIDR, bare address or range as accepted by
+// AddByString. fn is called once for every CIDR of a range.
+func (i *Tree[V]) UpsertByString(ipcidr string, fn func(old V, exists bool) V) error {
+	if isRange(ipcidr) {
+		from, to, err := parseRange(ipcidr)
+		if err != nil {
+			return err
+		}
+		prefixes, err := RangePrefixes(from, to)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			if err := i.Upsert(prefix, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		return err
+	}
+	return i.target(zone, true).Upsert(prefix, fn)
+}
+
+// UpsertBatch calls UpsertByString for each of cidrs, stopping at the first
+// error.
+func (i *Tree[V]) UpsertBatch(cidrs []string, fn func(old V, exists bool) V) error {
+	for _, cidr := range cidrs {
+		if err := i.UpsertByString(cidr, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store puts v at prefix, whose node n was looked up by exactNode and may be
+// nil. Only nodes already holding an entry are updated in place, as nradix
+// links each new entry to the entries covering it when inserting.
+func (i *Tree[V]) store(prefix netip.Prefix, n *nradix.Node, v V) error {
+	had := n != nil && n.GetValue() != nil
+	// nradix treats a nil value as no entry at all.
+	has := any(v) != nil
+	if had {
+		n.SetValue(v)
+	} else if err := i.R.SetCIDRNetIPPrefix(prefix, v, true); err != nil {
+		return &PrefixError{Op: "add", Input: prefix.String(), Err: err}
+	}
+	switch {
+	case has && !had:
+		i.count(prefix, 1)
+	case had && !has:
+		i.count(prefix, -1)
+	}
+	i.record(prefix, v, has)
+	if i.v4 == nil {
+		i.refreshV4()
+	}
+	return nil
+}
+
+// remove deletes the single entry at prefix, returning ErrNotFound if there
+// is none.
+func (i *Tree[V]) remove(prefix netip.Prefix) error {
+	prefix, ok := i.entryPrefix(prefix)
+	if n := i.exactNode(prefix); !ok || n == nil || n.GetValue() == nil {
+		return notFound(prefix.String())
+	}
+	if err := i.deleteEntry(prefix); err != nil {
+		return err
+	}
+	i.count(prefix, -1)
+	var zero V
+	i.record(prefix, zero, false)
+	i.refreshV4()
+	return nil
+}
+
+// removeZoned is remove for a prefix in zone.
+func (i *Tree[V]) removeZoned(prefix netip.Prefix, zone string) error {
+	t := i.target(zone, false)
+	if t == nil {
+		return notFound(prefix.Addr().WithZone(zone).String() + "/" + strconv.Itoa(prefix.Bits()))
 	}
+	return t.remove(prefix)
 }
 
-func (i *IPTree) GetNetIPAddr(nip netip.Addr) (interface{}, bool, error) {
-	v, err := i.R.FindCIDRNetIPAddr(nip)
-	if v != nil {
-		return v, true, err
+// count adjusts the entry count of prefix's family by delta.
+func (i *Tree[V]) count(prefix netip.Prefix, delta int) {
+	if prefix.Addr().Is4() {
+		i.v4Len += delta
 	} else {
-		return v, false, err
+		i.v6Len += delta
+	}
+}
+
+// Len returns the number of entries in the tree, including zone-scoped
+// entries, which walks and iterators over the tree do not visit. Use Zones and
+// Zone to reach those.
+func (i *Tree[V]) Len() int {
+	return i.v4Len + i.LenV6()
+}
+
+// LenV4 returns the number of IPv4 entries in the tree.
+func (i *Tree[V]) LenV4() int {
+	return i.v4Len
+}
+
+// LenV6 returns the number of IPv6 entries in the tree, including
+// zone-scoped entries.
+func (i *Tree[V]) LenV6() int {
+	n := i.v6Len
+	for _, z := range i.zones {
+		n += z.Len()
 	}
+	return n
 }
 
-func (i *IPTree) DeleteByString(ipstr string) error {
-	return i.R.DeleteCIDRString(ipstr)
+func (i *Tree[V]) Get(ip net.IP) (V, bool, error) {
+	return i.GetNetIP(ip)
 }
 
-func (i *IPTree) DeleteByNetIP(ip net.IP, mask net.IPMask) error {
-	return i.R.DeleteCIDRNetIP(ip, mask)
+func (i *Tree[V]) GetByString(ipstr string) (V, bool, error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return i.get(prefix, zone)
+}
+
+// GetIPNet returns the value of the longest entry covering ip. An IPv4 ip is
+// looked up by its address alone, whatever its mask, as it always has been.
+func (i *Tree[V]) GetIPNet(ip net.IPNet) (V, bool, error) {
+	prefix, err := ipNetLookup(ip)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return i.get(prefix, "")
+}
+
+func (i *Tree[V]) GetNetIP(ip net.IP) (V, bool, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return i.get4([4]byte(ip4))
+	}
+	nip, err := netIPAddr(ip)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return i.get(netip.PrefixFrom(nip, nip.BitLen()), "")
 }
 
-func (i *IPTree) DeleteByNetIPAddr(nip netip.Addr, mask netip.Prefix) error {
-	return i.R.DeleteCIDRNetIPAddr(nip, mask)
+func (i *Tree[V]) GetNetIPAddr(nip netip.Addr) (V, bool, error) {
+	if !nip.IsValid() {
+		var zero V
+		return zero, false, invalidPrefix(nip.String(), nil)
+	}
+	return i.get(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
 }
 
-// AddBatch adds multiple CIDR entries to the tree at once
-func (i *IPTree) AddBatch(cidrs []string, v interface{}) error {
+func (i *Tree[V]) get(prefix netip.Prefix, zone string) (V, bool, error) {
+	if z := i.scope(zone); z != nil {
+		if v, found, err := z.get(prefix, ""); found {
+			return v, found, err
+		}
+	}
+	if prefix.Addr().Is4() && prefix.IsSingleIP() {
+		return i.get4(prefix.Addr().As4())
+	}
+	node, _ := i.lookup(i.lookupPrefix(prefix))
+	if node == nil {
+		var zero V
+		return zero, false, nil
+	}
+	return typed[V](node.GetValue(), nil)
+}
+
+// get4 returns the value of the longest entry covering an IPv4 address, which
+// no policy or zone affects.
+func (i *Tree[V]) get4(addr [4]byte) (V, bool, error) {
+	node := i.lookup4(addr)
+	if node == nil {
+		var zero V
+		return zero, false, nil
+	}
+	return typed[V](node.GetValue(), nil)
+}
+
+// GetWithPrefixByString returns the value of the longest prefix covering the
+// given address or CIDR, along with that prefix.
+func (i *Tree[V]) GetWithPrefixByString(ipstr string) (V, netip.Prefix, bool, error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	return i.getWithPrefix(prefix, zone)
+}
+
+// GetWithPrefixNetIP returns the value of the longest prefix covering ip,
+// along with that prefix.
+func (i *Tree[V]) GetWithPrefixNetIP(ip net.IP) (V, netip.Prefix, bool, error) {
+	nip, err := netIPAddr(ip)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	return i.GetWithPrefixNetIPAddr(nip)
+}
+
+// GetWithPrefixNetIPAddr returns the value of the longest prefix covering nip,
+// along with that prefix.
+func (i *Tree[V]) GetWithPrefixNetIPAddr(nip netip.Addr) (V, netip.Prefix, bool, error) {
+	if !nip.IsValid() {
+		var zero V
+		return zero, netip.Prefix{}, false, invalidPrefix(nip.String(), nil)
+	}
+	return i.getWithPrefix(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+func (i *Tree[V]) getWithPrefix(prefix netip.Prefix, zone string) (V, netip.Prefix, bool, error) {
+	if z := i.scope(zone); z != nil {
+		if v, match, found, err := z.getWithPrefix(prefix, ""); found {
+			return v, match, found, err
+		}
+	}
+	node, match := i.findNode(i.lookupPrefix(prefix))
+	if node == nil {
+		var zero V
+		return zero, netip.Prefix{}, false, nil
+	}
+	v, found, err := typed[V](node.GetValue(), nil)
+	if !found {
+		return v, netip.Prefix{}, false, err
+	}
+	return v, match, true, err
+}
+
+// GetAllMatches returns every entry whose prefix contains nip, ordered from
+// the most to the least specific.
+func (i *Tree[V]) GetAllMatches(nip netip.Addr) []Entry[V] {
+	if !nip.IsValid() {
+		return nil
+	}
+	return i.allMatches(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+// GetAllMatchesByString returns every entry whose prefix contains the given
+// address or CIDR, ordered from the most to the least specific.
+func (i *Tree[V]) GetAllMatchesByString(ipstr string) ([]Entry[V], error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		return nil, err
+	}
+	return i.allMatches(prefix, zone), nil
+}
+
+func (i *Tree[V]) allMatches(prefix netip.Prefix, zone string) []Entry[V] {
+	var matches []Entry[V]
+	i.coveringNodes(i.lookupPrefix(prefix), func(n *nradix.Node, match netip.Prefix) {
+		if v, ok := n.GetValue().(V); ok {
+			matches = append(matches, Entry[V]{Prefix: match, Value: v})
+		}
+	})
+	slices.Reverse(matches)
+	if z := i.scope(zone); z != nil {
+		// Entries in the zone take precedence over all others.
+		matches = append(z.allMatches(prefix, ""), matches...)
+	}
+	return matches
+}
+
+// netIPAddr converts a net.IP into an address. IPv4 addresses in their 16 byte
+// form are treated as IPv4, as the net package does.
+func netIPAddr(ip net.IP) (netip.Addr, error) {
+	nip, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, invalidPrefix(ip.String(), nil)
+	}
+	if ip.To4() != nil {
+		nip = nip.Unmap()
+	}
+	return nip, nil
+}
+
+// normalizePrefix masks prefix and turns IPv4-mapped IPv6 prefixes covering no
+// more than the IPv4 space into the IPv4 prefixes nradix stores them as.
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= v4Depth {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-v4Depth).Masked()
+	}
+	return prefix.Masked()
+}
+
+// ipNetPrefix converts a net.IP and mask into a prefix. IPv4 addresses in their
+// 16 byte form are treated as IPv4, as the net package does. Host bits are
+// kept so the adds can apply the tree's host bits policy.
+func ipNetPrefix(ip net.IP, mask net.IPMask) (netip.Prefix, error) {
+	invalid := func() error {
+		return invalidPrefix((&net.IPNet{IP: ip, Mask: mask}).String(), nil)
+	}
+	addr, err := netIPAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, invalid()
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return netip.Prefix{}, invalid()
+	}
+	if addr.Is4() {
+		if bits == 128 {
+			if ones < v4Depth {
+				return netip.Prefix{}, invalid()
+			}
+			ones -= v4Depth
+		}
+	} else if bits != 128 {
+		return netip.Prefix{}, invalid()
+	}
+	return netip.PrefixFrom(addr, ones), nil
+}
+
+// cidrPrefix is ipNetPrefix for the *net.IPNet arguments, rejecting nil.
+func cidrPrefix(cidr *net.IPNet) (netip.Prefix, error) {
+	if cidr == nil {
+		return netip.Prefix{}, invalidPrefix(cidr.String(), nil)
+	}
+	return ipNetPrefix(cidr.IP, cidr.Mask)
+}
+
+// ipNetLookup converts the argument of GetIPNet into the prefix it looks up,
+// which for IPv4 is the address alone.
+func ipNetLookup(ipnet net.IPNet) (netip.Prefix, error) {
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(ip4)), 32), nil
+	}
+	return ipNetPrefix(ipnet.IP, ipnet.Mask)
+}
+
+// parsePrefixOrAddr parses either a CIDR or a bare address, which is treated
+// as a host prefix. An IPv6 zone is dropped.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	prefix, _, err := parseZoned(s)
+	return prefix, err
+}
+
+// GetExact returns the value stored for exactly prefix. Unlike the Get
+// family it does not fall back to a covering prefix.
+func (i *Tree[V]) GetExact(prefix netip.Prefix) (V, bool) {
+	prefix, ok := i.entryPrefix(prefix)
+	if !prefix.IsValid() || !ok {
+		var zero V
+		return zero, false
+	}
+	node := i.exactNode(prefix)
+	if node == nil {
+		var zero V
+		return zero, false
+	}
+	v, found, _ := typed[V](node.GetValue(), nil)
+	return v, found
+}
+
+// GetExactByString returns the value stored for exactly the given CIDR. A bare
+// address is treated as a host prefix.
+func (i *Tree[V]) GetExactByString(ipcidr string) (V, bool, error) {
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	t := i.target(zone, false)
+	if t == nil {
+		var zero V
+		return zero, false, nil
+	}
+	v, found := t.GetExact(prefix)
+	return v, found, nil
+}
+
+// GetExactIPNet returns the value stored for exactly cidr.
+func (i *Tree[V]) GetExactIPNet(cidr *net.IPNet) (V, bool, error) {
+	prefix, err := cidrPrefix(cidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	v, found := i.GetExact(prefix)
+	return v, found, nil
+}
+
+// HasPrefix reports whether exactly prefix was inserted into the tree.
+func (i *Tree[V]) HasPrefix(prefix netip.Prefix) bool {
+	_, found := i.GetExact(prefix)
+	return found
+}
+
+// HasPrefixByString reports whether exactly the given CIDR was inserted into the tree.
+func (i *Tree[V]) HasPrefixByString(ipcidr string) (bool, error) {
+	_, found, err := i.GetExactByString(ipcidr)
+	return found, err
+}
+
+// HasPrefixIPNet reports whether exactly cidr was inserted into the tree.
+func (i *Tree[V]) HasPrefixIPNet(cidr *net.IPNet) (bool, error) {
+	_, found, err := i.GetExactIPNet(cidr)
+	return found, err
+}
+
+func (i *Tree[V]) DeleteByString(ipstr string) error {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		return err
+	}
+	return i.removeZoned(prefix, zone)
+}
+
+func (i *Tree[V]) DeleteByNetIP(ip net.IP, mask net.IPMask) error {
+	prefix, err := ipNetPrefix(ip, mask)
+	if err != nil {
+		return err
+	}
+	return i.remove(prefix)
+}
+
+func (i *Tree[V]) DeleteByNetIPAddr(nip netip.Addr, mask netip.Prefix) error {
+	prefix := netip.PrefixFrom(nip, mask.Bits())
+	if !prefix.IsValid() {
+		return invalidPrefix(nip.String()+"/"+strconv.Itoa(mask.Bits()), nil)
+	}
+	return i.removeZoned(prefix, nip.Zone())
+}
+
+// DeleteSubtree removes prefix and every more specific entry beneath it,
+// returning the number of entries removed.
+func (i *Tree[V]) DeleteSubtree(prefix netip.Prefix) (int, error) {
+	if !prefix.IsValid() {
+		return 0, invalidPrefix(prefix.String(), nil)
+	}
+	var doomed []netip.Prefix
+	_ = i.walkWithin(prefix, func(n *nradix.Node, prefix netip.Prefix) error {
+		doomed = append(doomed, prefix)
+		return nil
+	})
+
+	// Remove the most specific entries first so nradix trims each emptied
+	// branch as it goes.
+	removed := 0
+	defer i.refreshV4()
+	var zero V
+	for n := len(doomed) - 1; n >= 0; n-- {
+		if err := i.deleteEntry(doomed[n]); err != nil {
+			return removed, err
+		}
+		i.count(doomed[n], -1)
+		i.record(doomed[n], zero, false)
+		removed++
+	}
+	return removed, nil
+}
+
+// DeleteSubtreeByString removes the given CIDR and every more specific entry
+// beneath it, returning the number of entries removed.
+func (i *Tree[V]) DeleteSubtreeByString(ipcidr string) (int, error) {
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		return 0, err
+	}
+	t := i.target(zone, false)
+	if t == nil {
+		return 0, nil
+	}
+	return t.DeleteSubtree(prefix)
+}
+
+// deleteEntry removes the single entry at prefix.
+func (i *Tree[V]) deleteEntry(prefix netip.Prefix) error {
+	if prefix.Bits() == 0 && !prefix.Addr().Is4() {
+		// nradix cannot trim its root, so clear ::/0 in place.
+		i.root().SetValue(nil)
+		return nil
+	}
+	if err := i.R.DeleteCIDRNetIPAddr(prefix.Addr(), prefix); err != nil {
+		return &PrefixError{Op: "delete", Input: prefix.String(), Err: err}
+	}
+	return nil
+}
+
+// AddBatch adds multiple CIDR entries to the tree at once. Entries may also be
+// bare addresses or ranges, as for AddByString.
+func (i *Tree[V]) AddBatch(cidrs []string, v V) error {
+	return i.addBatch(cidrs, v, true)
+}
+
+// AddBatchIfAbsent is AddBatch without overwriting. It stops with ErrExists at
+// the first entry already in the tree, keeping the entries added before it.
+func (i *Tree[V]) AddBatchIfAbsent(cidrs []string, v V) error {
+	return i.addBatch(cidrs, v, false)
+}
+
+func (i *Tree[V]) addBatch(cidrs []string, v V, overwrite bool) error {
 	for _, cidr := range cidrs {
-		if err := i.AddByString(cidr, v); err != nil {
+		if err := i.addString(cidr, v, overwrite); err != nil {
 			return err
 		}
 	}
@@ -119,59 +706,104 @@ func (i *IPTree) AddBatch(cidrs []string, v interface{}) error {
 }
 
 // GetAll returns all entries in the IPTree as a map of CIDR strings to their values
-func (i *IPTree) GetAll() map[string]interface{} {
-	result := make(map[string]interface{})
-	_ = i.WalkV4String(func(prefix string, value interface{}) error {
+func (i *Tree[V]) GetAll() map[string]V {
+	result := make(map[string]V)
+	_ = i.WalkV4String(func(prefix string, value V) error {
 		result[prefix] = value
 		return nil
 	})
-	_ = i.WalkV6String(func(prefix string, value interface{}) error {
+	_ = i.WalkV6String(func(prefix string, value V) error {
 		result[prefix] = value
 		return nil
 	})
 	return result
 }
 
-// WalkV4Prefix iterates through all entries in the IPTree, calling the provided function
-// for each entry. If the callback returns false, iteration stops.
-func (i *IPTree) WalkV4Prefix(callback func(prefix netip.Prefix, value interface{}) error) error {
-	return i.R.WalkV4(func(prefix netip.Prefix, value interface{}) error {
-		if err := callback(prefix, value); err != nil {
-			return err
+// Clone returns an independent copy of the tree. Values are copied as they
+// are, so values holding pointers are shared between the two trees.
+func (i *Tree[V]) Clone() *Tree[V] {
+	c := NewTree[V]()
+	c.opts = i.opts
+	copyEntry := func(n *nradix.Node, prefix netip.Prefix) error {
+		if v, ok := n.GetValue().(V); ok {
+			return c.set(prefix, v, true)
 		}
 		return nil
-	})
+	}
+	_ = i.walkWithin(allV4, copyEntry)
+	_ = i.walkWithin(allV6, copyEntry)
+	for name, z := range i.zones {
+		c.setZone(name, z.Clone())
+	}
+	return c
 }
 
-// WalkV4String iterates through all entries in the IPTree, calling the provided function
-// for each entry. If the callback returns false, iteration stops.
-func (i *IPTree) WalkV4String(callback func(prefix string, value interface{}) error) error {
-	return i.R.WalkV4(func(prefix netip.Prefix, value interface{}) error {
-		if err := callback(prefix.String(), value); err != nil {
-			return err
+// WalkWithin calls callback in address order for every entry whose prefix is
+// equal to or more specific than prefix. Iteration stops at the first error
+// returned by callback, which is returned unchanged.
+func (i *Tree[V]) WalkWithin(prefix netip.Prefix, callback func(prefix netip.Prefix, value V) error) error {
+	if !prefix.IsValid() {
+		return invalidPrefix(prefix.String(), nil)
+	}
+	return i.walkWithin(prefix, func(n *nradix.Node, prefix netip.Prefix) error {
+		v, ok := n.GetValue().(V)
+		if !ok {
+			return nil
 		}
+		return callback(prefix, v)
+	})
+}
+
+// GetAllWithin returns every entry whose prefix is equal to or more specific
+// than prefix, in address order.
+func (i *Tree[V]) GetAllWithin(prefix netip.Prefix) []Entry[V] {
+	var result []Entry[V]
+	_ = i.WalkWithin(prefix, func(prefix netip.Prefix, value V) error {
+		result = append(result, Entry[V]{Prefix: prefix, Value: value})
 		return nil
 	})
+	return result
 }
 
-// WalkV6Prefix iterates through all entries in the IPTree, calling the provided function
-// for each entry. If the callback returns false, iteration stops.
-func (i *IPTree) WalkV6Prefix(callback func(prefix netip.Prefix, value interface{}) error) error {
-	return i.R.WalkV6(func(prefix netip.Prefix, value interface{}) error {
-		if err := callback(prefix, value); err != nil {
+// walkFunc adapts a typed callback to the untyped nradix walker, skipping
+// any value that is not a V.
+func walkFunc[V any](callback func(prefix netip.Prefix, value V) error) nradix.WalkFunc {
+	return func(prefix netip.Prefix, value interface{}) error {
+		v, ok := value.(V)
+		if !ok {
+			return nil
+		}
+		if err := callback(prefix, v); err != nil {
 			return err
 		}
 		return nil
-	})
+	}
+}
+
+// WalkV4Prefix iterates through all entries in the IPTree, calling the provided function
+// for each entry. If the callback returns false, iteration stops.
+func (i *Tree[V]) WalkV4Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return i.R.WalkV4(walkFunc(callback))
+}
+
+// WalkV4String iterates through all entries in the IPTree, calling the provided function
+// for each entry. If the callback returns false, iteration stops.
+func (i *Tree[V]) WalkV4String(callback func(prefix string, value V) error) error {
+	return i.R.WalkV4(walkFunc(func(prefix netip.Prefix, value V) error {
+		return callback(prefix.String(), value)
+	}))
+}
+
+// WalkV6Prefix iterates through all entries in the IPTree, calling the provided function
+// for each entry. If the callback returns false, iteration stops.
+func (i *Tree[V]) WalkV6Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return i.R.WalkV6(walkFunc(callback))
 }
 
 // WalkV6String iterates through all entries in the IPTree, calling the provided function
 // for each entry. If the callback returns false, iteration stops.
-func (i *IPTree) WalkV6String(callback func(prefix string, value interface{}) error) error {
-	return i.R.WalkV6(func(prefix netip.Prefix, value interface{}) error {
-		if err := callback(prefix.String(), value); err != nil {
-			return err
-		}
-		return nil
-	})
+func (i *Tree[V]) WalkV6String(callback func(prefix string, value V) error) error {
+	return i.R.WalkV6(walkFunc(func(prefix netip.Prefix, value V) error {
+		return callback(prefix.String(), value)
+	}))
 }
@@ -1,8 +1,11 @@
 package iptree
 
 import (
+	"math/rand"
 	"net"
 	"net/netip"
+	"runtime"
+	"slices"
 	"testing"
 )
 
@@ -2178,3 +2181,233 @@ func BenchmarkIPtreeNetIPAddr(b *testing.B) {
 		tree.GetNetIPAddr(nip)
 	}
 }
+
+func BenchmarkFrozenNetIPAddr(b *testing.B) {
+	tree := initiptree(b).Freeze()
+
+	nip := netip.MustParseAddr("192.168.1.1")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.GetNetIPAddr(nip)
+	}
+}
+
+func BenchmarkClone(b *testing.B) {
+	tree := initiptree(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Clone()
+	}
+}
+
+func BenchmarkPersistentInsert(b *testing.B) {
+	tree := initiptree(b).Snapshot()
+
+	prefix := netip.MustParsePrefix("192.168.1.0/24")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Insert(prefix, 2)
+	}
+}
+
+func benchmarkGetBatch(b *testing.B, sorted bool) {
+	tree := initiptree(b)
+	addrs := batchAddrs(10000)
+	if sorted {
+		slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	}
+	out := make([]any, len(addrs))
+	found := make([]bool, len(addrs))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.GetBatch(addrs, out, found)
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(addrs)), "ns/addr")
+}
+
+func BenchmarkGetBatch(b *testing.B) {
+	benchmarkGetBatch(b, false)
+}
+
+func BenchmarkGetBatchSorted(b *testing.B) {
+	benchmarkGetBatch(b, true)
+}
+
+// BenchmarkGetBatchSortFirst sorts the addresses before every GetBatch, as a
+// caller whose addresses arrive unsorted would.
+func BenchmarkGetBatchSortFirst(b *testing.B) {
+	tree := initiptree(b)
+	addrs := batchAddrs(10000)
+	sorted := make([]netip.Addr, len(addrs))
+	out := make([]any, len(addrs))
+	found := make([]bool, len(addrs))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(sorted, addrs)
+		slices.SortFunc(sorted, func(a, b netip.Addr) int { return a.Compare(b) })
+		tree.GetBatch(sorted, out, found)
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(addrs)), "ns/addr")
+}
+
+func benchmarkGetNetIPAddrLoop(b *testing.B, sorted bool) {
+	tree := initiptree(b)
+	addrs := batchAddrs(10000)
+	if sorted {
+		slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, addr := range addrs {
+			tree.GetNetIPAddr(addr)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(addrs)), "ns/addr")
+}
+
+func BenchmarkGetNetIPAddrLoop(b *testing.B) {
+	benchmarkGetNetIPAddrLoop(b, false)
+}
+
+func BenchmarkGetNetIPAddrLoopSorted(b *testing.B) {
+	benchmarkGetNetIPAddrLoop(b, true)
+}
+
+// largeList returns n random prefixes, a tenth of them IPv6, as strings.
+func largeList(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	list := make([]string, n)
+	for k := range list {
+		var prefix netip.Prefix
+		if k%10 == 0 {
+			var a [16]byte
+			r.Read(a[:])
+			prefix = netip.PrefixFrom(netip.AddrFrom16(a), 16+r.Intn(113))
+		} else {
+			var a [4]byte
+			r.Read(a[:])
+			prefix = netip.PrefixFrom(netip.AddrFrom4(a), 8+r.Intn(25))
+		}
+		list[k] = prefix.Masked().String()
+	}
+	return list
+}
+
+func BenchmarkLoadAddByString(b *testing.B) {
+	list := largeList(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := NewTree[int]()
+		for _, s := range list {
+			tree.AddByString(s, 1)
+		}
+	}
+}
+
+func BenchmarkLoadPersistentInsertByString(b *testing.B) {
+	list := largeList(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := NewPersistentTree[int]()
+		for _, s := range list {
+			tree, _ = tree.InsertByString(s, 1)
+		}
+	}
+}
+
+func benchmarkLoadBuilder(b *testing.B, sorted, persistent bool) {
+	list := largeList(100000)
+	if sorted {
+		slices.SortFunc(list, func(x, y string) int {
+			return comparePrefixes(netip.MustParsePrefix(x), netip.MustParsePrefix(y))
+		})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		builder := NewBuilder[int](len(list))
+		for _, s := range list {
+			builder.AddByString(s, 1)
+		}
+		if persistent {
+			builder.Persistent()
+		} else {
+			builder.Tree()
+		}
+	}
+}
+
+func BenchmarkLoadBuilder(b *testing.B) {
+	benchmarkLoadBuilder(b, false, false)
+}
+
+func BenchmarkLoadBuilderSorted(b *testing.B) {
+	benchmarkLoadBuilder(b, true, false)
+}
+
+func BenchmarkLoadBuilderPersistent(b *testing.B) {
+	benchmarkLoadBuilder(b, false, true)
+}
+
+func BenchmarkLoadBuilderPersistentSorted(b *testing.B) {
+	benchmarkLoadBuilder(b, true, true)
+}
+
+func BenchmarkFrozenGetNetIPAddrLoop(b *testing.B) {
+	tree := initiptree(b).Freeze()
+	addrs := batchAddrs(10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, addr := range addrs {
+			tree.GetNetIPAddr(addr)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(addrs)), "ns/addr")
+}
+
+// heapBytes returns the heap memory still held by what build returns.
+func heapBytes(build func() any) int {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(v)
+	return int(after.HeapAlloc) - int(before.HeapAlloc)
+}
+
+// BenchmarkFreeze reports the memory a large tree takes before and after
+// freezing it, per prefix.
+func BenchmarkFreeze(b *testing.B) {
+	tree := NewTree[int]()
+	for k, s := range largeList(100000) {
+		tree.AddByString(s, k)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Freeze()
+	}
+	b.StopTimer()
+
+	treeBytes := heapBytes(func() any {
+		t := NewTree[int]()
+		for k, s := range largeList(100000) {
+			t.AddByString(s, k)
+		}
+		return t
+	})
+	frozenBytes := heapBytes(func() any { return tree.Freeze() })
+	b.ReportMetric(float64(treeBytes)/float64(tree.Len()), "tree-B/prefix")
+	b.ReportMetric(float64(frozenBytes)/float64(tree.Len()), "frozen-B/prefix")
+}
@@ -15,8 +15,13 @@
 package iptree
 
 import (
+	"errors"
+	"net"
 	"net/netip"
+	"slices"
 	"testing"
+
+	"github.com/iqhive/nradix"
 )
 
 func TestCreate(t *testing.T) {
@@ -320,3 +325,759 @@ func TestManualWalkV4Prefix(t *testing.T) {
 	// }
 	// t.Error("test")
 }
+
+func TestTypedTree(t *testing.T) {
+	ip := NewTree[string]()
+	ip.AddByString("10.0.0.0/8", "ten")
+	ip.AddByString("10.1.0.0/16", "ten-one")
+	ip.AddByString("2001:db8::/32", "doc")
+	if val, found, _ := ip.GetByString("10.1.2.3"); !found || val != "ten-one" {
+		t.Errorf("Typed lookup returned %q, %v", val, found)
+	}
+	if val, found, _ := ip.GetNetIPAddr(netip.MustParseAddr("10.2.0.1")); !found || val != "ten" {
+		t.Errorf("Typed lookup returned %q, %v", val, found)
+	}
+	if val, found, _ := ip.GetByString("192.168.0.1"); found || val != "" {
+		t.Errorf("Lookup outside tree returned %q, %v", val, found)
+	}
+
+	all := ip.GetAll()
+	if len(all) != 3 || all["10.1.0.0/16"] != "ten-one" || all["2001:db8::/32"] != "doc" {
+		t.Errorf("GetAll returned %v", all)
+	}
+}
+
+func TestGetWithPrefix(t *testing.T) {
+	ip := New()
+	ip.AddByString("0.0.0.0/0", 1)
+	ip.AddByString("192.0.0.0/8", 2)
+	ip.AddByString("192.168.0.0/16", 3)
+	ip.AddByString("192.168.1.0/24", 4)
+	ip.AddByString("2001:db8::/32", 5)
+	ip.AddByString("2001:db8:1::/48", 6)
+
+	tests := []struct {
+		ip     string
+		prefix string
+		value  int
+	}{
+		{"192.168.0.1", "192.168.0.0/16", 3},
+		{"192.168.1.1", "192.168.1.0/24", 4},
+		{"192.1.2.3", "192.0.0.0/8", 2},
+		{"8.8.8.8", "0.0.0.0/0", 1},
+		{"2001:db8::1", "2001:db8::/32", 5},
+		{"2001:db8:1::1", "2001:db8:1::/48", 6},
+		{"192.168.1.0/25", "192.168.1.0/24", 4},
+		{"192.168.0.0/15", "192.0.0.0/8", 2},
+	}
+	for _, tt := range tests {
+		val, prefix, found, err := ip.GetWithPrefixByString(tt.ip)
+		if err != nil || !found {
+			t.Errorf("Lookup of %s failed: %v, %v", tt.ip, found, err)
+			continue
+		}
+		if prefix.String() != tt.prefix || val.(int) != tt.value {
+			t.Errorf("Lookup of %s returned %s=%v, expected %s=%d", tt.ip, prefix, val, tt.prefix, tt.value)
+		}
+	}
+
+	val, prefix, found, _ := ip.GetWithPrefixNetIPAddr(netip.MustParseAddr("192.168.1.200"))
+	if !found || prefix.String() != "192.168.1.0/24" || val.(int) != 4 {
+		t.Errorf("Lookup of netip.Addr returned %s=%v", prefix, val)
+	}
+	val, prefix, found, _ = ip.GetWithPrefixNetIP(net.ParseIP("192.168.1.200"))
+	if !found || prefix.String() != "192.168.1.0/24" || val.(int) != 4 {
+		t.Errorf("Lookup of 16 byte net.IP returned %s=%v", prefix, val)
+	}
+	if _, _, found, _ := ip.GetWithPrefixByString("2002::1"); found {
+		t.Error("Found IPv6 address outside of any IPv6 prefix")
+	}
+	if _, _, _, err := ip.GetWithPrefixByString("not an ip"); err == nil {
+		t.Error("Expected error for malformed address")
+	}
+}
+
+func TestGetNetIPAddrV6(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("2001:db8::/32", 1)
+	if val, found, err := ip.GetNetIPAddr(netip.MustParseAddr("2001:db8::1")); err != nil || !found || val != 1 {
+		t.Errorf("IPv6 lookup returned %d, %v, %v", val, found, err)
+	}
+	if _, found, _ := ip.GetNetIPAddr(netip.MustParseAddr("2001:db9::1")); found {
+		t.Error("IPv6 lookup outside prefix found a value")
+	}
+}
+
+func TestGetIPNet(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("10.0.0.0/25", 2)
+	ip.AddByString("2001:db8::/32", 3)
+	ip.AddByString("2001:db8::/64", 4)
+
+	// IPv4 networks are looked up by their address alone.
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/24")
+	if val, found, err := ip.GetIPNet(*ipnet); err != nil || !found || val != 2 {
+		t.Errorf("GetIPNet(%s) returned %d, %v, %v; expected 2", ipnet, val, found, err)
+	}
+	if val, _, _ := ip.Snapshot().GetIPNet(*ipnet); val != 2 {
+		t.Errorf("PersistentTree.GetIPNet(%s) returned %d, expected 2", ipnet, val)
+	}
+	if val, _, _ := ip.Freeze().GetIPNet(*ipnet); val != 2 {
+		t.Errorf("FrozenTree.GetIPNet(%s) returned %d, expected 2", ipnet, val)
+	}
+	_, ipnet, _ = net.ParseCIDR("2001:db8::/48")
+	if val, found, err := ip.GetIPNet(*ipnet); err != nil || !found || val != 3 {
+		t.Errorf("GetIPNet(%s) returned %d, %v, %v; expected 3", ipnet, val, found, err)
+	}
+	if _, _, err := ip.GetIPNet(net.IPNet{}); err == nil {
+		t.Error("Expected error for an empty IPNet")
+	}
+}
+
+func TestGetExact(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("10.1.0.0/16", 2)
+	ip.AddByString("2001:db8::/32", 3)
+
+	if val, found := ip.GetExact(netip.MustParsePrefix("10.0.0.0/8")); !found || val != 1 {
+		t.Errorf("Exact lookup of 10.0.0.0/8 returned %d, %v", val, found)
+	}
+	if _, found := ip.GetExact(netip.MustParsePrefix("10.0.0.0/9")); found {
+		t.Error("Exact lookup matched a covering prefix")
+	}
+	if _, found := ip.GetExact(netip.MustParsePrefix("10.1.2.0/24")); found {
+		t.Error("Exact lookup matched a covering prefix")
+	}
+	if !ip.HasPrefix(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Error("HasPrefix did not find 10.1.0.0/16")
+	}
+	if ip.HasPrefix(netip.MustParsePrefix("10.0.0.0/7")) {
+		t.Error("HasPrefix found a prefix that was never inserted")
+	}
+
+	if found, err := ip.HasPrefixByString("2001:db8::/32"); err != nil || !found {
+		t.Errorf("HasPrefixByString returned %v, %v", found, err)
+	}
+	if found, _ := ip.HasPrefixByString("2001:db8::/48"); found {
+		t.Error("HasPrefixByString matched a covering prefix")
+	}
+	if found, _ := ip.HasPrefixByString("10.0.0.1"); found {
+		t.Error("HasPrefixByString matched a covering prefix for a host address")
+	}
+	if _, err := ip.HasPrefixByString("10.0.0.0/33"); err == nil {
+		t.Error("Expected error for malformed CIDR")
+	}
+
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/16")
+	if val, found, err := ip.GetExactIPNet(ipnet); err != nil || !found || val != 2 {
+		t.Errorf("GetExactIPNet returned %d, %v, %v", val, found, err)
+	}
+	ipnet = &net.IPNet{IP: net.ParseIP("10.1.0.0"), Mask: net.CIDRMask(112, 128)}
+	if found, err := ip.HasPrefixIPNet(ipnet); err != nil || !found {
+		t.Errorf("HasPrefixIPNet with 16 byte IPv4 returned %v, %v", found, err)
+	}
+
+	ip.DeleteByString("10.0.0.0/8")
+	if ip.HasPrefix(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Error("HasPrefix found a deleted prefix")
+	}
+}
+
+func TestGetAllMatches(t *testing.T) {
+	ip := NewTree[string]()
+	ip.AddByString("0.0.0.0/0", "default")
+	ip.AddByString("10.0.0.0/8", "country")
+	ip.AddByString("10.1.0.0/16", "isp")
+	ip.AddByString("10.1.2.0/24", "customer")
+	ip.AddByString("10.2.0.0/16", "other isp")
+	ip.AddByString("2001:db8::/32", "v6")
+
+	matches := ip.GetAllMatches(netip.MustParseAddr("10.1.2.3"))
+	expected := []string{"10.1.2.0/24=customer", "10.1.0.0/16=isp", "10.0.0.0/8=country", "0.0.0.0/0=default"}
+	if len(matches) != len(expected) {
+		t.Fatalf("Expected %d matches, got %v", len(expected), matches)
+	}
+	for n, m := range matches {
+		if got := m.Prefix.String() + "=" + m.Value; got != expected[n] {
+			t.Errorf("Match %d is %s, expected %s", n, got, expected[n])
+		}
+	}
+
+	matches, err := ip.GetAllMatchesByString("10.3.0.1")
+	if err != nil || len(matches) != 2 || matches[0].Value != "country" {
+		t.Errorf("GetAllMatchesByString returned %v, %v", matches, err)
+	}
+	matches, _ = ip.GetAllMatchesByString("2001:db8::1")
+	if len(matches) != 1 || matches[0].Prefix.String() != "2001:db8::/32" {
+		t.Errorf("IPv6 matches returned %v", matches)
+	}
+	if matches, _ := ip.GetAllMatchesByString("2002::1"); len(matches) != 0 {
+		t.Errorf("Unexpected matches %v", matches)
+	}
+	if _, err := ip.GetAllMatchesByString("10.1"); err == nil {
+		t.Error("Expected error for malformed address")
+	}
+}
+
+func TestWalkWithin(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("0.0.0.0/0", 1)
+	ip.AddByString("10.0.0.0/8", 2)
+	ip.AddByString("10.1.0.0/16", 3)
+	ip.AddByString("10.1.2.0/24", 4)
+	ip.AddByString("10.200.0.0/16", 5)
+	ip.AddByString("11.0.0.0/8", 6)
+	ip.AddByString("2001:db8::/32", 7)
+	ip.AddByString("2001:db8:1::/48", 8)
+	ip.AddByString("2001:db9::/32", 9)
+
+	var visited []string
+	err := ip.WalkWithin(netip.MustParsePrefix("10.0.0.0/8"), func(prefix netip.Prefix, value int) error {
+		visited = append(visited, prefix.String())
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Walk failed: %v", err)
+	}
+	expected := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.200.0.0/16"}
+	if !slices.Equal(visited, expected) {
+		t.Errorf("Walk within 10.0.0.0/8 visited %v, expected %v", visited, expected)
+	}
+
+	entries := ip.GetAllWithin(netip.MustParsePrefix("10.1.0.0/15"))
+	if len(entries) != 2 || entries[0].Value != 3 || entries[1].Prefix.String() != "10.1.2.0/24" {
+		t.Errorf("GetAllWithin(10.1.0.0/15) returned %v", entries)
+	}
+	if entries := ip.GetAllWithin(netip.MustParsePrefix("12.0.0.0/8")); len(entries) != 0 {
+		t.Errorf("GetAllWithin(12.0.0.0/8) returned %v", entries)
+	}
+	if entries := ip.GetAllWithin(netip.MustParsePrefix("0.0.0.0/0")); len(entries) != 6 {
+		t.Errorf("GetAllWithin(0.0.0.0/0) returned %v", entries)
+	}
+	if entries := ip.GetAllWithin(netip.MustParsePrefix("::/0")); len(entries) != 3 {
+		t.Errorf("GetAllWithin(::/0) returned %v", entries)
+	}
+	entries = ip.GetAllWithin(netip.MustParsePrefix("2001:db8::/32"))
+	if len(entries) != 2 || entries[1].Prefix.String() != "2001:db8:1::/48" {
+		t.Errorf("GetAllWithin(2001:db8::/32) returned %v", entries)
+	}
+
+	stop := errors.New("stop")
+	visited = nil
+	err = ip.WalkWithin(netip.MustParsePrefix("10.0.0.0/8"), func(prefix netip.Prefix, value int) error {
+		visited = append(visited, prefix.String())
+		if len(visited) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(visited) != 2 {
+		t.Errorf("Walk did not stop early: %v, visited %v", err, visited)
+	}
+}
+
+func TestDeleteSubtree(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("0.0.0.0/0", 1)
+	ip.AddByString("10.0.0.0/8", 2)
+	ip.AddByString("10.16.0.0/20", 3)
+	ip.AddByString("10.16.1.0/24", 4)
+	ip.AddByString("10.16.2.0/24", 5)
+	ip.AddByString("10.16.2.7/32", 6)
+	ip.AddByString("10.17.0.0/16", 7)
+	ip.AddByString("2001:db8::/32", 8)
+
+	removed, err := ip.DeleteSubtree(netip.MustParsePrefix("10.16.0.0/20"))
+	if err != nil || removed != 4 {
+		t.Errorf("DeleteSubtree removed %d entries, %v; expected 4", removed, err)
+	}
+	for _, cidr := range []string{"10.16.0.0/20", "10.16.1.0/24", "10.16.2.0/24", "10.16.2.7/32"} {
+		if found, _ := ip.HasPrefixByString(cidr); found {
+			t.Errorf("Found %s after deleting its subtree", cidr)
+		}
+	}
+	if val, _, _ := ip.GetByString("10.16.2.7"); val != 2 {
+		t.Errorf("Lookup after DeleteSubtree returned %d, expected covering value 2", val)
+	}
+	if val, _, _ := ip.GetByString("10.17.0.1"); val != 7 {
+		t.Errorf("DeleteSubtree removed a sibling entry")
+	}
+
+	removed, err = ip.DeleteSubtreeByString("10.128.0.0/9")
+	if err != nil || removed != 0 {
+		t.Errorf("DeleteSubtree of empty range removed %d entries, %v", removed, err)
+	}
+
+	removed, _ = ip.DeleteSubtree(netip.MustParsePrefix("0.0.0.0/0"))
+	if removed != 3 {
+		t.Errorf("DeleteSubtree(0.0.0.0/0) removed %d entries, expected 3", removed)
+	}
+	if len(ip.GetAll()) != 1 {
+		t.Errorf("Expected only the IPv6 entry to remain, got %v", ip.GetAll())
+	}
+
+	// IPv4 lookups keep working once the IPv4 part of the tree was emptied
+	// and then rebuilt.
+	ip.AddByString("2001:db9::/32", 9)
+	ip.AddByString("5.0.0.0/8", 10)
+	if val, found, _ := ip.GetByString("5.1.1.1"); !found || val != 10 {
+		t.Errorf("Lookup after rebuilding IPv4 entries returned %d, %v", val, found)
+	}
+	if val, found, _ := ip.GetNetIPAddr(netip.MustParseAddr("5.1.1.1")); !found || val != 10 {
+		t.Errorf("Lookup after rebuilding IPv4 entries returned %d, %v", val, found)
+	}
+	if val, found, _ := ip.GetNetIP(net.ParseIP("5.1.1.1")); !found || val != 10 {
+		t.Errorf("Lookup after rebuilding IPv4 entries returned %d, %v", val, found)
+	}
+
+	removed, _ = ip.DeleteSubtree(netip.MustParsePrefix("::/0"))
+	if removed != 2 || len(ip.GetAll()) != 1 {
+		t.Errorf("DeleteSubtree(::/0) removed %d entries, left %v", removed, ip.GetAll())
+	}
+}
+
+func TestLen(t *testing.T) {
+	ip := NewTree[int]()
+	if ip.Len() != 0 || ip.LenV4() != 0 || ip.LenV6() != 0 {
+		t.Error("New tree is not empty")
+	}
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("10.0.0.0/8", 2)
+	ip.AddByString("10.1.0.0/16", 3)
+	ip.AddByNetIPAddr(netip.MustParseAddr("10.2.0.0"), netip.MustParsePrefix("10.2.0.0/16"), 4, true)
+	ip.AddByNetIPAddr(netip.MustParseAddr("10.2.0.0"), netip.MustParsePrefix("10.2.0.0/16"), 5, false)
+	_, ipnet, _ := net.ParseCIDR("2001:db8::/32")
+	ip.Add(ipnet, 6)
+	ip.AddByNetIP(net.ParseIP("2001:db8:1::"), net.CIDRMask(48, 128), 7)
+	ip.AddBatch([]string{"192.168.0.0/24", "192.168.1.0/24", "10.1.0.0/16"}, 8)
+	if ip.Len() != 7 || ip.LenV4() != 5 || ip.LenV6() != 2 {
+		t.Errorf("Expected 7 entries (5 IPv4, 2 IPv6), got %d (%d, %d)", ip.Len(), ip.LenV4(), ip.LenV6())
+	}
+
+	if err := ip.DeleteByString("10.0.0.0/8"); err != nil {
+		t.Error(err)
+	}
+	if err := ip.DeleteByString("10.0.0.0/8"); err == nil {
+		t.Error("Deleting a missing entry did not fail")
+	}
+	ip.DeleteByNetIPAddr(netip.MustParseAddr("2001:db8::"), netip.MustParsePrefix("2001:db8::/32"))
+	if ip.Len() != 5 || ip.LenV4() != 4 || ip.LenV6() != 1 {
+		t.Errorf("Expected 5 entries (4 IPv4, 1 IPv6), got %d (%d, %d)", ip.Len(), ip.LenV4(), ip.LenV6())
+	}
+
+	ip.DeleteSubtree(netip.MustParsePrefix("192.168.0.0/16"))
+	if ip.Len() != 3 || ip.LenV4() != 2 || ip.LenV6() != 1 {
+		t.Errorf("Expected 3 entries (2 IPv4, 1 IPv6), got %d (%d, %d)", ip.Len(), ip.LenV4(), ip.LenV6())
+	}
+	if n := len(ip.GetAll()); n != ip.Len() {
+		t.Errorf("Len is %d but the tree holds %d entries", ip.Len(), n)
+	}
+
+	untyped := New()
+	untyped.AddByString("1.0.0.0/8", 1)
+	untyped.AddByString("1.0.0.0/8", nil)
+	untyped.AddByString("2.0.0.0/8", nil)
+	if untyped.Len() != 0 {
+		t.Errorf("Storing nil values left %d entries", untyped.Len())
+	}
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	ip := NewTree[int]()
+	if err := ip.AddByStringIfAbsent("10.0.0.0/8", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	v6 := netip.MustParsePrefix("2001:db8::/32")
+	ip.AddByNetIPAddr(v6.Addr(), v6, 1, false)
+
+	adds := map[string]func() error{
+		"AddIfAbsent":         func() error { return ip.AddIfAbsent(cidr, 2) },
+		"AddByStringIfAbsent": func() error { return ip.AddByStringIfAbsent("10.1.2.3/8", 2) },
+		"AddByNetIPIfAbsent":  func() error { return ip.AddByNetIPIfAbsent(cidr.IP, cidr.Mask, 2) },
+		"AddByNetIPAddr":      func() error { return ip.AddByNetIPAddr(v6.Addr(), v6, 2, false) },
+		"AddBatchIfAbsent":    func() error { return ip.AddBatchIfAbsent([]string{"2001:db8::/32"}, 2) },
+		"AddRangeIfAbsent": func() error {
+			return ip.AddRangeIfAbsent(netip.MustParseAddr("9.255.255.255"), netip.MustParseAddr("10.255.255.255"), 2)
+		},
+	}
+	for name, add := range adds {
+		err := add()
+		if !errors.Is(err, ErrExists) {
+			t.Errorf("%s returned %v, expected ErrExists", name, err)
+		}
+		if !errors.Is(err, nradix.ErrNodeBusy) {
+			t.Errorf("%s returned %v, which no longer matches nradix.ErrNodeBusy", name, err)
+		}
+	}
+	if val, _, _ := ip.GetByString("10.0.0.1"); val != 1 {
+		t.Errorf("Adding without overwrite replaced the value with %d", val)
+	}
+	if val, _, _ := ip.GetByString("2001:db8::1"); val != 1 {
+		t.Errorf("Adding without overwrite replaced the value with %d", val)
+	}
+	if found, _ := ip.HasPrefixByString("9.255.255.255/32"); found {
+		t.Error("AddRangeIfAbsent added part of a range that was already present")
+	}
+
+	if err := ip.AddBatchIfAbsent([]string{"11.0.0.0/8", "12.0.0.0/8"}, 3); err != nil {
+		t.Errorf("AddBatchIfAbsent of new entries failed: %v", err)
+	}
+	if err := ip.AddByString("10.0.0.0/8", 4); err != nil {
+		t.Errorf("AddByString did not overwrite: %v", err)
+	}
+	if ip.Len() != 4 {
+		t.Errorf("Expected 4 entries, found %d", ip.Len())
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	ip := NewTree[[]string]()
+	tag := func(name string) func(old []string, exists bool) []string {
+		return func(old []string, exists bool) []string {
+			if exists && slices.Contains(old, name) {
+				return old
+			}
+			return append(slices.Clone(old), name)
+		}
+	}
+	if err := ip.UpsertBatch([]string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}, tag("feed-a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.UpsertBatch([]string{"10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32"}, tag("feed-b")); err != nil {
+		t.Fatal(err)
+	}
+	ip.Upsert(netip.MustParsePrefix("10.0.0.0/8"), tag("feed-a"))
+
+	for cidr, expected := range map[string][]string{
+		"10.0.0.0/8":     {"feed-a", "feed-b"},
+		"10.1.0.0/16":    {"feed-b"},
+		"192.168.0.0/16": {"feed-a"},
+		"2001:db8::/32":  {"feed-a", "feed-b"},
+	} {
+		if val, _, _ := ip.GetExactByString(cidr); !slices.Equal(val, expected) {
+			t.Errorf("Tags for %s are %v, expected %v", cidr, val, expected)
+		}
+	}
+	if ip.Len() != 4 {
+		t.Errorf("Expected 4 entries, found %d", ip.Len())
+	}
+
+	scores := NewTree[int]()
+	maxOf := func(score int) func(old int, exists bool) int {
+		return func(old int, exists bool) int {
+			return max(old, score)
+		}
+	}
+	scores.UpsertByString("1.2.3.0-1.2.3.127", maxOf(5))
+	scores.UpsertByString("1.2.3.0/25", maxOf(3))
+	scores.UpsertByString("1.2.3.0/25", maxOf(7))
+	if val, _, _ := scores.GetByString("1.2.3.4"); val != 7 {
+		t.Errorf("Score for 1.2.3.4 is %d, expected 7", val)
+	}
+	if err := scores.UpsertByString("1.2.3.0/33", maxOf(1)); err == nil {
+		t.Error("Expected error upserting an invalid prefix")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("115.254.0.0/17", 3)
+	_, _, getErr := ip.GetByString("115.254.0.1.1")
+
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		input  string
+	}{
+		{"AddByString", ip.AddByString("115.254.0.0/33", 1), ErrInvalidPrefix, "115.254.0.0/33"},
+		{"AddByString", ip.AddByString("not an address", 1), ErrInvalidPrefix, "not an address"},
+		{"AddByString", ip.AddByString("1.2.3.9-1.2.3.4", 1), ErrInvalidRange, "1.2.3.9-1.2.3.4"},
+		{"AddByString", ip.AddByString("1.2.3.4-x", 1), ErrInvalidRange, "1.2.3.4-x"},
+		{"AddByStringIfAbsent", ip.AddByStringIfAbsent("115.254.0.0/17", 1), ErrExists, "115.254.0.0/17"},
+		{"AddByNetIP", ip.AddByNetIP(net.IP{1, 2, 3}, net.CIDRMask(8, 32), 1), ErrInvalidPrefix, ""},
+		{"DeleteByString", ip.DeleteByString("115.254.0.0/22"), ErrNotFound, "115.254.0.0/22"},
+		{"DeleteByString", ip.DeleteByString("115.254.0.0/"), ErrInvalidPrefix, "115.254.0.0/"},
+		{"GetByString", getErr, ErrInvalidPrefix, "115.254.0.1.1"},
+	}
+	for _, test := range tests {
+		if !errors.Is(test.err, test.target) {
+			t.Errorf("%s returned %v, expected %v", test.name, test.err, test.target)
+			continue
+		}
+		var perr *PrefixError
+		if !errors.As(test.err, &perr) {
+			t.Errorf("%s returned %T, expected a *PrefixError", test.name, test.err)
+			continue
+		}
+		if test.input != "" && perr.Input != test.input {
+			t.Errorf("%s reported input %q, expected %q", test.name, perr.Input, test.input)
+		}
+	}
+	if err := ip.DeleteByString("115.254.0.0/22"); !errors.Is(err, nradix.ErrNotFound) {
+		t.Errorf("DeleteByString returned %v, expected it to match nradix.ErrNotFound", err)
+	}
+	if err := ip.AddByString("not an address", 1); !errors.Is(err, nradix.ErrBadIP) {
+		t.Errorf("AddByString returned %v, expected it to match nradix.ErrBadIP", err)
+	}
+	var perr *PrefixError
+	if err := ip.Add(nil, 1); !errors.Is(err, nradix.ErrBadIP) || !errors.As(err, &perr) {
+		t.Errorf("Add(nil) returned %v, expected a *PrefixError matching nradix.ErrBadIP", err)
+	}
+	if _, _, err := ip.GetExactIPNet(nil); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("GetExactIPNet(nil) returned %v, expected ErrInvalidPrefix", err)
+	}
+	if ip.Len() != 1 {
+		t.Errorf("Failed calls changed the tree")
+	}
+}
+
+func TestHostBitsPolicy(t *testing.T) {
+	v6 := netip.MustParsePrefix("2001:db8::1/32")
+	ipnet := &net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)}
+	adds := map[string]func(ip *Tree[int]) error{
+		"Add":            func(ip *Tree[int]) error { return ip.Add(ipnet, 1) },
+		"AddByString":    func(ip *Tree[int]) error { return ip.AddByString("1.2.3.4/24", 1) },
+		"AddByNetIP":     func(ip *Tree[int]) error { return ip.AddByNetIP(net.ParseIP("1.2.3.4"), net.CIDRMask(120, 128), 1) },
+		"AddByNetIPAddr": func(ip *Tree[int]) error { return ip.AddByNetIPAddr(v6.Addr(), v6, 1, true) },
+		"Upsert": func(ip *Tree[int]) error {
+			return ip.Upsert(v6, func(int, bool) int { return 1 })
+		},
+	}
+
+	for name, add := range adds {
+		ip := NewTree[int]()
+		if err := add(ip); err != nil || ip.Len() != 1 {
+			t.Errorf("%s with the default policy returned %v", name, err)
+		}
+
+		ip = NewTree[int]()
+		ip.SetHostBitsPolicy(HostBitsReject, nil)
+		if err := add(ip); !errors.Is(err, ErrHostBitsSet) || ip.Len() != 0 {
+			t.Errorf("%s with HostBitsReject returned %v", name, err)
+		}
+		if err := ip.AddByString("1.2.3.0/24", 1); err != nil {
+			t.Errorf("HostBitsReject rejected a masked prefix: %v", err)
+		}
+
+		ip = NewTree[int]()
+		var warned []string
+		ip.SetHostBitsPolicy(HostBitsWarn, func(given, masked netip.Prefix) {
+			warned = append(warned, given.String()+" "+masked.String())
+		})
+		if err := add(ip); err != nil || ip.Len() != 1 || len(warned) != 1 {
+			t.Errorf("%s with HostBitsWarn returned %v and warned %v", name, err, warned)
+		}
+	}
+
+	ip := NewTree[int]()
+	ip.SetHostBitsPolicy(HostBitsWarn, func(given, masked netip.Prefix) {
+		if given.String() != "1.2.3.4/24" || masked.String() != "1.2.3.0/24" {
+			t.Errorf("Warned about %s masked to %s", given, masked)
+		}
+	})
+	ip.AddByString("1.2.3.4/24", 1)
+	if found, _ := ip.HasPrefixByString("1.2.3.0/24"); !found {
+		t.Error("HostBitsWarn did not store the masked prefix")
+	}
+	ip.SetHostBitsPolicy(HostBitsReject, nil)
+	if err := ip.Clone().AddByString("1.2.3.4/24", 2); !errors.Is(err, ErrHostBitsSet) {
+		t.Errorf("Clone did not keep the host bits policy: %v", err)
+	}
+}
+
+func TestMappedPolicy(t *testing.T) {
+	mapped := netip.MustParseAddr("::ffff:1.2.3.4")
+	other := netip.MustParseAddr("::ffff:5.6.7.8")
+	newTree := func(policy MappedPolicy) *Tree[int] {
+		ip := NewTree[int]()
+		ip.SetMappedPolicy(policy)
+		ip.AddByString("1.2.3.0/24", 4)
+		ip.AddByString("::/0", 6)
+		return ip
+	}
+
+	tests := []struct {
+		policy       MappedPolicy
+		mappedVal    int
+		mappedPrefix string
+		otherVal     int
+	}{
+		{MappedMatchBoth, 4, "1.2.3.0/24", 6},
+		{MappedUnmap, 4, "1.2.3.0/24", 0},
+		{MappedKeep, 6, "::/0", 6},
+	}
+	for _, test := range tests {
+		ip := newTree(test.policy)
+		val, prefix, _, _ := ip.GetWithPrefixNetIPAddr(mapped)
+		if val != test.mappedVal || prefix.String() != test.mappedPrefix {
+			t.Errorf("Policy %d: lookup of %s returned %d from %s", test.policy, mapped, val, prefix)
+		}
+		if val, _, _ := ip.GetByString(other.String()); val != test.otherVal {
+			t.Errorf("Policy %d: lookup of %s returned %d", test.policy, other, val)
+		}
+		if matches := ip.GetAllMatches(mapped); len(matches) == 0 || matches[0].Value != test.mappedVal {
+			t.Errorf("Policy %d: GetAllMatches(%s) returned %v", test.policy, mapped, matches)
+		}
+
+		// A net.IP in its 16 byte form is IPv4 whatever the policy.
+		for _, nip := range []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("::ffff:1.2.3.4"), net.IPv4(1, 2, 3, 4).To16()} {
+			if val, _, _ := ip.GetNetIP(nip); val != 4 {
+				t.Errorf("Policy %d: lookup of 16 byte %s returned %d", test.policy, nip, val)
+			}
+			if found, _ := ip.HasPrefixIPNet(&net.IPNet{IP: nip.Mask(net.CIDRMask(120, 128)), Mask: net.CIDRMask(120, 128)}); !found {
+				t.Errorf("Policy %d: 16 byte %s/120 did not name 1.2.3.0/24", test.policy, nip)
+			}
+		}
+	}
+
+	// Adds, deletes and walks of mapped prefixes act on the IPv4 entries
+	// unless the policy keeps them apart.
+	for _, policy := range []MappedPolicy{MappedMatchBoth, MappedUnmap} {
+		ip := newTree(policy)
+		if err := ip.AddByString("::ffff:5.6.7.0/120", 5); err != nil || !ip.HasPrefix(netip.MustParsePrefix("5.6.7.0/24")) {
+			t.Errorf("Policy %d: adding a mapped prefix failed: %v", policy, err)
+		}
+		within := ip.GetAllWithin(netip.MustParsePrefix("::ffff:5.0.0.0/104"))
+		if len(within) != 1 || within[0].Prefix.String() != "5.6.7.0/24" {
+			t.Errorf("Policy %d: walk of a mapped prefix returned %v", policy, within)
+		}
+		if err := ip.DeleteByString("::ffff:5.6.7.0/120"); err != nil || ip.LenV4() != 1 {
+			t.Errorf("Policy %d: deleting a mapped prefix failed: %v", policy, err)
+		}
+	}
+	ip := newTree(MappedKeep)
+	if err := ip.AddByString("::ffff:5.6.7.0/120", 5); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("MappedKeep: adding a mapped prefix returned %v", err)
+	}
+	if within := ip.GetAllWithin(netip.MustParsePrefix("::ffff:1.0.0.0/104")); len(within) != 0 {
+		t.Errorf("MappedKeep: walk of a mapped prefix returned %v", within)
+	}
+	if err := ip.DeleteByString("::ffff:1.2.3.0/120"); !errors.Is(err, ErrNotFound) || ip.LenV4() != 1 {
+		t.Errorf("MappedKeep: deleting a mapped prefix returned %v", err)
+	}
+	if ip.HasPrefix(netip.MustParsePrefix("::ffff:1.2.3.0/120")) {
+		t.Error("MappedKeep: a mapped prefix named an IPv4 entry")
+	}
+	if ip.Clone().AddByString("::ffff:5.6.7.0/120", 5) == nil {
+		t.Error("Clone did not keep the mapped policy")
+	}
+}
+
+func TestZones(t *testing.T) {
+	eth0 := netip.MustParseAddr("fe80::1%eth0")
+	eth1 := netip.MustParseAddr("fe80::1%eth1")
+
+	// Zones are stripped by default.
+	ip := NewTree[int]()
+	if err := ip.AddByString("fe80::%eth0/10", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.AddByString("fe80::2%eth0", 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []netip.Addr{eth0, eth1, eth0.WithZone("")} {
+		if val, found, err := ip.GetNetIPAddr(addr); err != nil || !found || val != 1 {
+			t.Errorf("Lookup of %s returned %d, %v, %v", addr, val, found, err)
+		}
+	}
+	if val, _, _ := ip.GetByString("fe80::2%eth1"); val != 2 {
+		t.Errorf("Lookup of fe80::2%%eth1 returned %d", val)
+	}
+	if found, _ := ip.HasPrefixByString("fe80::/10"); !found || len(ip.Zones()) != 0 {
+		t.Error("Zone was not stripped from an added prefix")
+	}
+
+	// Scoped entries only match addresses in their zone, which fall back to
+	// the entries without a zone.
+	ip = NewTree[int]()
+	ip.SetZonePolicy(ZoneScoped)
+	ip.AddByString("fe80::/10", 1)
+	ip.AddByString("fe80::%eth0/64", 2)
+	ip.AddByNetIPAddr(eth1, netip.PrefixFrom(eth1, 128), 3, true)
+	if ip.Len() != 3 || !slices.Equal(ip.Zones(), []string{"eth0", "eth1"}) {
+		t.Errorf("Expected 3 entries in zones eth0 and eth1, found %d in %v", ip.Len(), ip.Zones())
+	}
+
+	for addr, expected := range map[string]int{
+		"fe80::1":      1,
+		"fe80::1%eth0": 2,
+		"fe80::1%eth1": 3,
+		"fe80::2%eth1": 1,
+		"fe80::1%eth2": 1,
+	} {
+		if val, _, _ := ip.GetByString(addr); val != expected {
+			t.Errorf("GetByString(%s) returned %d, expected %d", addr, val, expected)
+		}
+		if val, _, _ := ip.GetNetIPAddr(netip.MustParseAddr(addr)); val != expected {
+			t.Errorf("GetNetIPAddr(%s) returned %d, expected %d", addr, val, expected)
+		}
+	}
+	if _, prefix, _, _ := ip.GetWithPrefixNetIPAddr(eth0); prefix.String() != "fe80::/64" {
+		t.Errorf("Lookup of %s matched %s", eth0, prefix)
+	}
+	if matches := ip.GetAllMatches(eth0); len(matches) != 2 || matches[0].Value != 2 || matches[1].Value != 1 {
+		t.Errorf("GetAllMatches(%s) returned %v", eth0, matches)
+	}
+	if found, _ := ip.HasPrefixByString("fe80::/64"); found {
+		t.Error("A zone-scoped entry was found without its zone")
+	}
+	if found, _ := ip.HasPrefixByString("fe80::%eth0/64"); !found {
+		t.Error("A zone-scoped entry was not found in its zone")
+	}
+	if z := ip.Zone("eth0"); z == nil || !z.HasPrefix(netip.MustParsePrefix("fe80::/64")) {
+		t.Error("Zone did not return the zone's entries")
+	}
+
+	// Dashes in zone names do not make a range.
+	if err := ip.AddByString("fe80::%br-lan/64", 4); err != nil {
+		t.Fatalf("Adding in a dashed zone failed: %v", err)
+	}
+	if err := ip.UpsertByString("fe80::1%br-lan", func(int, bool) int { return 5 }); err != nil {
+		t.Fatalf("Upserting in a dashed zone failed: %v", err)
+	}
+	if val, _, _ := ip.GetByString("fe80::2%br-lan"); val != 4 {
+		t.Errorf("Lookup in a dashed zone returned %d", val)
+	}
+	if val, _, _ := ip.GetByString("fe80::1%br-lan"); val != 5 {
+		t.Errorf("Lookup in a dashed zone returned %d", val)
+	}
+	if _, err := ip.OverlapsByString("fe80::%br-lan/64", 4, Equal[int]); err != nil {
+		t.Errorf("OverlapsByString in a dashed zone failed: %v", err)
+	}
+	if err := NewBuilder[int](0).AddByString("fe80::%br-lan/64", 4); err != nil {
+		t.Errorf("Builder.AddByString in a dashed zone failed: %v", err)
+	}
+	ip.DeleteByString("fe80::%br-lan/64")
+	ip.DeleteByString("fe80::1%br-lan")
+
+	c := ip.Clone()
+	if err := ip.DeleteByString("fe80::/64"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleting a zone-scoped entry without its zone returned %v", err)
+	}
+	if err := ip.DeleteByString("fe80::%eth0/64"); err != nil {
+		t.Errorf("Deleting a zone-scoped entry failed: %v", err)
+	}
+	if err := ip.DeleteByNetIPAddr(eth1, netip.PrefixFrom(eth1, 128)); err != nil {
+		t.Errorf("Deleting a zone-scoped entry failed: %v", err)
+	}
+	if err := ip.DeleteByString("fe80::%eth2/64"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleting from a zone without entries returned %v", err)
+	}
+	if val, _, _ := ip.GetNetIPAddr(eth0); val != 1 || ip.Len() != 1 || len(ip.Zones()) != 0 {
+		t.Errorf("Zone-scoped entries were not deleted")
+	}
+	if val, _, _ := c.GetNetIPAddr(eth0); val != 2 || c.Len() != 3 {
+		t.Errorf("Clone shared zone-scoped entries with the original")
+	}
+
+	if _, _, err := ip.GetByString("fe80::1%eth0/129"); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Expected ErrInvalidPrefix, got %v", err)
+	}
+	if _, _, err := ip.GetByString("1.2.3.4%eth0"); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Expected ErrInvalidPrefix, got %v", err)
+	}
+}
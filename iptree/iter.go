@@ -0,0 +1,56 @@
+package iptree
+
+import (
+	"errors"
+	"iter"
+	"net/netip"
+)
+
+// errStopIteration ends a walk when the consumer of an iterator stops early.
+var errStopIteration = errors.New("iptree: iteration stopped")
+
+var (
+	allV4 = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	allV6 = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+)
+
+// All returns an iterator over every entry in the tree, IPv4 entries first,
+// each family in address order with covering prefixes before the prefixes
+// they contain.
+func (i *Tree[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		for prefix, v := range i.AllV4() {
+			if !yield(prefix, v) {
+				return
+			}
+		}
+		for prefix, v := range i.AllV6() {
+			if !yield(prefix, v) {
+				return
+			}
+		}
+	}
+}
+
+// AllV4 returns an iterator over every IPv4 entry in address order.
+func (i *Tree[V]) AllV4() iter.Seq2[netip.Prefix, V] {
+	return i.Within(allV4)
+}
+
+// AllV6 returns an iterator over every IPv6 entry in address order.
+func (i *Tree[V]) AllV6() iter.Seq2[netip.Prefix, V] {
+	return i.Within(allV6)
+}
+
+// Within returns an iterator over every entry equal to or more specific than
+// prefix, in address order.
+func (i *Tree[V]) Within(prefix netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		_ = i.WalkWithin(prefix, func(prefix netip.Prefix, value V) error {
+			if !yield(prefix, value) {
+				return errStopIteration
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package iptree
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("2001:db8:1::/48", 1)
+	ip.AddByString("192.168.1.0/24", 2)
+	ip.AddByString("10.0.0.0/8", 3)
+	ip.AddByString("2001:db8::/32", 4)
+	ip.AddByString("10.1.0.0/16", 5)
+	ip.AddByString("::/0", 6)
+
+	var visited []string
+	for prefix, v := range ip.All() {
+		visited = append(visited, prefix.String())
+		if got, _ := ip.GetExact(prefix); got != v {
+			t.Errorf("Iterator returned %d for %s, tree holds %d", v, prefix, got)
+		}
+	}
+	expected := []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.0/24", "::/0", "2001:db8::/32", "2001:db8:1::/48"}
+	if !slices.Equal(visited, expected) {
+		t.Errorf("All visited %v, expected %v", visited, expected)
+	}
+
+	visited = nil
+	for prefix := range ip.AllV4() {
+		visited = append(visited, prefix.String())
+	}
+	if !slices.Equal(visited, expected[:3]) {
+		t.Errorf("AllV4 visited %v", visited)
+	}
+
+	visited = nil
+	for prefix := range ip.AllV6() {
+		visited = append(visited, prefix.String())
+	}
+	if !slices.Equal(visited, expected[3:]) {
+		t.Errorf("AllV6 visited %v", visited)
+	}
+
+	visited = nil
+	for prefix := range ip.Within(netip.MustParsePrefix("10.0.0.0/8")) {
+		visited = append(visited, prefix.String())
+	}
+	if !slices.Equal(visited, expected[:2]) {
+		t.Errorf("Within visited %v", visited)
+	}
+}
+
+func TestAllBreak(t *testing.T) {
+	ip := NewTree[int]()
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "11.0.0.0/8", "2001:db8::/32"} {
+		ip.AddByString(cidr, 1)
+	}
+
+	count := 0
+	for range ip.All() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Iteration continued after break, visited %d", count)
+	}
+
+	count = 0
+	for range ip.All() {
+		count++
+		if count == 4 {
+			break
+		}
+	}
+	if count != 4 {
+		t.Errorf("Iteration continued after break in IPv6 entries, visited %d", count)
+	}
+}
@@ -0,0 +1,221 @@
+package iptree
+
+import (
+	"net/netip"
+
+	"github.com/iqhive/nradix"
+)
+
+// v4Depth is the depth in the underlying tree at which IPv4 entries start.
+// nradix stores IPv4 prefixes as IPv4-mapped IPv6 prefixes below ::ffff:0:0/96.
+const v4Depth = 96
+
+// treeKey returns the 16 byte key and depth under which nradix stores prefix.
+func treeKey(prefix netip.Prefix) ([16]byte, int) {
+	if prefix.Addr().Is4() {
+		return prefix.Addr().As16(), prefix.Bits() + v4Depth
+	}
+	return prefix.Addr().As16(), prefix.Bits()
+}
+
+// keyPrefix converts a key and depth in the underlying tree back into the
+// prefix the caller inserted, undoing the IPv4 mapping when is4 is set.
+func keyPrefix(key [16]byte, depth int, is4 bool) netip.Prefix {
+	if is4 {
+		return netip.PrefixFrom(netip.AddrFrom16(key).Unmap(), depth-v4Depth).Masked()
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(key), depth).Masked()
+}
+
+// entryKeyPrefix is keyPrefix for a node on the path to key, telling IPv4
+// entries apart by their place in the tree, so lookups of IPv4-mapped
+// addresses report the IPv4 entries they match as IPv4 prefixes.
+func entryKeyPrefix(key [16]byte, depth int) netip.Prefix {
+	return keyPrefix(key, depth, depth >= v4Depth && isV4Space(&key))
+}
+
+// keyBit reports whether the bit at depth is set in key.
+func keyBit(key *[16]byte, depth int) bool {
+	return key[depth/8]&(0x80>>(depth%8)) != 0
+}
+
+// child returns the child of n that key follows at depth.
+func child(n *nradix.Node, key *[16]byte, depth int) *nradix.Node {
+	if keyBit(key, depth) {
+		return n.GetRight()
+	}
+	return n.GetLeft()
+}
+
+// root returns the root node of the underlying tree. nradix never frees its
+// root, so it is found once by climbing from any node.
+func (i *Tree[V]) root() *nradix.Node {
+	if i.top != nil {
+		return i.top
+	}
+	n, _, _ := i.R.FindCIDRNetIPAddrWithNode(netip.IPv4Unspecified())
+	for n.GetTreeParent() != nil {
+		n = n.GetTreeParent()
+	}
+	return n
+}
+
+// v4Key is the key of the ::ffff:0:0/96 node all IPv4 entries sit below.
+var v4Key = netip.IPv4Unspecified().As16()
+
+// refreshV4 re-resolves the node all IPv4 entries sit below. nradix trims that
+// node once its last IPv4 entry is deleted, after which its own IPv4 shortcut
+// points outside the tree, so Tree tracks the node itself after every change.
+func (i *Tree[V]) refreshV4() {
+	n := i.root()
+	for depth := 0; n != nil && depth < v4Depth; depth++ {
+		n = child(n, &v4Key, depth)
+	}
+	i.v4 = n
+}
+
+// start returns the node and depth at which lookups of the given family begin.
+func (i *Tree[V]) start(is4 bool) (*nradix.Node, int) {
+	if !is4 {
+		return i.root(), 0
+	}
+	if i.v4 != nil {
+		return i.v4, v4Depth
+	}
+	// Not resolved yet, e.g. for a Tree built without New.
+	n := i.root()
+	for depth := 0; n != nil && depth < v4Depth; depth++ {
+		n = child(n, &v4Key, depth)
+	}
+	return n, v4Depth
+}
+
+// lookup returns the node holding the longest entry that covers prefix and
+// its depth in the underlying tree. IPv4 prefixes only match IPv4 entries.
+func (i *Tree[V]) lookup(prefix netip.Prefix) (best *nradix.Node, bestDepth int) {
+	key, bits := treeKey(prefix)
+	n, depth := i.start(prefix.Addr().Is4())
+	for ; n != nil; depth++ {
+		if n.GetValue() != nil {
+			best, bestDepth = n, depth
+		}
+		if depth == bits {
+			break
+		}
+		n = child(n, &key, depth)
+	}
+	return best, bestDepth
+}
+
+// lookup4 is lookup for an IPv4 address. It steps through the address as an
+// integer, as nradix's own IPv4 lookups do, which keeps the lookups of single
+// IPv4 addresses as fast as nradix's.
+func (i *Tree[V]) lookup4(addr [4]byte) *nradix.Node {
+	ip := uint32(addr[0])<<24 | uint32(addr[1])<<16 | uint32(addr[2])<<8 | uint32(addr[3])
+	var best *nradix.Node
+	n, _ := i.start(true)
+	for bit := uint32(1) << 31; n != nil; bit >>= 1 {
+		if n.GetValue() != nil {
+			best = n
+		}
+		if bit == 0 {
+			break
+		}
+		if ip&bit != 0 {
+			n = n.GetRight()
+		} else {
+			n = n.GetLeft()
+		}
+	}
+	return best
+}
+
+// findNode returns the node holding the longest entry that covers prefix,
+// along with that entry's prefix.
+func (i *Tree[V]) findNode(prefix netip.Prefix) (*nradix.Node, netip.Prefix) {
+	best, depth := i.lookup(prefix)
+	if best == nil {
+		return nil, netip.Prefix{}
+	}
+	key, _ := treeKey(prefix)
+	return best, entryKeyPrefix(key, depth)
+}
+
+// exactNode returns the node at exactly prefix, or nil if the tree has no node
+// there. The node may not hold a value.
+func (i *Tree[V]) exactNode(prefix netip.Prefix) *nradix.Node {
+	key, bits := treeKey(prefix)
+	n, depth := i.start(prefix.Addr().Is4())
+	for ; n != nil && depth < bits; depth++ {
+		n = child(n, &key, depth)
+	}
+	return n
+}
+
+// coveringNodes calls fn for every node holding an entry that covers prefix,
+// from the least to the most specific.
+func (i *Tree[V]) coveringNodes(prefix netip.Prefix, fn func(n *nradix.Node, match netip.Prefix)) {
+	key, bits := treeKey(prefix)
+	n, depth := i.start(prefix.Addr().Is4())
+	for ; n != nil; depth++ {
+		if n.GetValue() != nil {
+			fn(n, entryKeyPrefix(key, depth))
+		}
+		if depth == bits {
+			break
+		}
+		n = child(n, &key, depth)
+	}
+}
+
+// isV4Space reports whether key lies in the ::ffff:0:0/96 range nradix uses
+// for IPv4 entries.
+func isV4Space(key *[16]byte) bool {
+	return *(*[12]byte)(key[:12]) == [12]byte{10: 0xff, 11: 0xff}
+}
+
+// walkNodes calls fn in address order for every node holding an entry at or
+// below n, which sits at depth along key. Walks of IPv6 prefixes skip the
+// IPv4 part of the tree. The first error returned by fn stops the walk.
+func walkNodes(n *nradix.Node, key [16]byte, depth int, is4 bool, fn func(n *nradix.Node, prefix netip.Prefix) error) error {
+	if !is4 && depth == v4Depth && isV4Space(&key) {
+		return nil
+	}
+	if n.GetValue() != nil {
+		if err := fn(n, keyPrefix(key, depth, is4)); err != nil {
+			return err
+		}
+	}
+	if depth == 128 {
+		return nil
+	}
+	mask := byte(0x80 >> (depth % 8))
+	if left := n.GetLeft(); left != nil {
+		key[depth/8] &^= mask
+		if err := walkNodes(left, key, depth+1, is4, fn); err != nil {
+			return err
+		}
+	}
+	if right := n.GetRight(); right != nil {
+		key[depth/8] |= mask
+		if err := walkNodes(right, key, depth+1, is4, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkWithin calls fn for every node holding an entry equal to or more
+// specific than prefix.
+func (i *Tree[V]) walkWithin(prefix netip.Prefix, fn func(n *nradix.Node, prefix netip.Prefix) error) error {
+	prefix, ok := i.entryPrefix(prefix)
+	if !ok {
+		return nil
+	}
+	n := i.exactNode(prefix)
+	if n == nil {
+		return nil
+	}
+	key, depth := treeKey(prefix)
+	return walkNodes(n, key, depth, prefix.Addr().Is4(), fn)
+}
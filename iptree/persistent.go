@@ -0,0 +1,807 @@
+package iptree
+
+import (
+	"iter"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// PersistentTree is an immutable prefix tree. Insert and Delete leave the tree
+// they are called on untouched and return a new version that shares every
+// node off the modified path with it, so keeping many versions of a large
+// tree costs only the nodes that differ between them. All versions are safe
+// for concurrent use.
+//
+// A PersistentTree keeps the policies and zone-scoped entries of the Tree it
+// was taken from, and its lookups, walks and iterators behave as the Tree's
+// do.
+//
+// Use Tree.Snapshot to take a PersistentTree from a Tree, and
+// PersistentTree.Tree to turn a version back into a mutable Tree.
+type PersistentTree[V any] struct {
+	v4, v6 *pnode[V]
+	v4Len  int
+	v6Len  int
+	opts   options
+	zones  map[string]*PersistentTree[V]
+}
+
+// pnode is a node of a PersistentTree. Nodes are never modified once they are
+// reachable from a published version.
+type pnode[V any] struct {
+	left, right *pnode[V]
+	value       V
+	ok          bool
+}
+
+// NewPersistentTree returns an empty PersistentTree.
+func NewPersistentTree[V any]() *PersistentTree[V] {
+	return new(PersistentTree[V])
+}
+
+// pkey returns the key and length under which a PersistentTree stores prefix.
+// IPv4 prefixes use the first four bytes of the key.
+func pkey(prefix netip.Prefix) ([16]byte, int) {
+	if prefix.Addr().Is4() {
+		var key [16]byte
+		a4 := prefix.Addr().As4()
+		copy(key[:], a4[:])
+		return key, prefix.Bits()
+	}
+	return prefix.Addr().As16(), prefix.Bits()
+}
+
+// pprefix converts a key and depth back into a prefix.
+func pprefix(key [16]byte, depth int, is4 bool) netip.Prefix {
+	if is4 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(key[:4])), depth).Masked()
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(key), depth).Masked()
+}
+
+// family returns the root pointer for prefix's address family.
+func (p *PersistentTree[V]) family(is4 bool) **pnode[V] {
+	if is4 {
+		return &p.v4
+	}
+	return &p.v6
+}
+
+// Len returns the number of entries in the tree, including zone-scoped
+// entries.
+func (p *PersistentTree[V]) Len() int {
+	return p.v4Len + p.LenV6()
+}
+
+// LenV4 returns the number of IPv4 entries in the tree.
+func (p *PersistentTree[V]) LenV4() int {
+	return p.v4Len
+}
+
+// LenV6 returns the number of IPv6 entries in the tree, including
+// zone-scoped entries.
+func (p *PersistentTree[V]) LenV6() int {
+	n := p.v6Len
+	for _, z := range p.zones {
+		n += z.Len()
+	}
+	return n
+}
+
+// Zone returns the version holding the entries scoped to zone, or nil if
+// there are none.
+func (p *PersistentTree[V]) Zone(zone string) *PersistentTree[V] {
+	return p.zones[zone]
+}
+
+// Zones returns the names of the zones holding entries, sorted.
+func (p *PersistentTree[V]) Zones() []string {
+	var names []string
+	for name, z := range p.zones {
+		if z.Len() > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// scope returns the version zone-scoped lookups of zone should try before p,
+// or nil if there is none.
+func (p *PersistentTree[V]) scope(zone string) *PersistentTree[V] {
+	if zone == "" || p.opts.zone != ZoneScoped {
+		return nil
+	}
+	return p.zones[zone]
+}
+
+// Insert returns a version of the tree with v stored at prefix. Host bits are
+// masked off, and a prefix the mapped policy cannot store leaves the tree as
+// it is; InsertByString applies every policy.
+func (p *PersistentTree[V]) Insert(prefix netip.Prefix, v V) *PersistentTree[V] {
+	if !prefix.IsValid() {
+		return p
+	}
+	prefix, ok := p.opts.entryPrefix(prefix)
+	if !ok {
+		return p
+	}
+	return p.insert(prefix, v)
+}
+
+// InsertByString returns a version of the tree with v stored at the given
+// CIDR, bare address or range, as Tree.AddByString would store it. On error
+// the tree is returned as it is, even for a range of which some CIDRs could
+// have been stored.
+func (p *PersistentTree[V]) InsertByString(ipcidr string, v V) (*PersistentTree[V], error) {
+	if isRange(ipcidr) {
+		from, to, err := parseRange(ipcidr)
+		if err != nil {
+			return p, err
+		}
+		prefixes, err := RangePrefixes(from, to)
+		if err != nil {
+			return p, err
+		}
+		next := p
+		for _, prefix := range prefixes {
+			if next, err = next.add(prefix, v); err != nil {
+				return p, err
+			}
+		}
+		return next, nil
+	}
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		return p, err
+	}
+	if zone == "" || p.opts.zone != ZoneScoped {
+		return p.add(prefix, v)
+	}
+	z := p.zones[zone]
+	if z == nil {
+		z = &PersistentTree[V]{opts: p.opts}
+	}
+	if z, err = z.add(prefix, v); err != nil {
+		return p, err
+	}
+	return p.withZone(zone, z), nil
+}
+
+// add returns a version of the tree with v stored at prefix after applying
+// the host bits and mapped policies, as the adds of a Tree do.
+func (p *PersistentTree[V]) add(prefix netip.Prefix, v V) (*PersistentTree[V], error) {
+	prefix, err := p.opts.addPrefix(prefix)
+	if err != nil {
+		return p, err
+	}
+	return p.insert(prefix, v), nil
+}
+
+// insert returns a version of the tree with v stored at the entry prefix.
+func (p *PersistentTree[V]) insert(prefix netip.Prefix, v V) *PersistentTree[V] {
+	key, bits := pkey(prefix)
+	next := *p
+	root := next.family(prefix.Addr().Is4())
+	var added bool
+	*root, added = pinsert(*root, &key, 0, bits, v)
+	if added {
+		next.count(prefix, 1)
+	}
+	return &next
+}
+
+// Delete returns a version of the tree without the entry at prefix, and
+// whether there was such an entry.
+func (p *PersistentTree[V]) Delete(prefix netip.Prefix) (*PersistentTree[V], bool) {
+	if !prefix.IsValid() {
+		return p, false
+	}
+	prefix, ok := p.opts.entryPrefix(prefix)
+	if !ok {
+		return p, false
+	}
+	return p.delete(prefix)
+}
+
+// delete returns a version of the tree without the entry at the entry prefix.
+func (p *PersistentTree[V]) delete(prefix netip.Prefix) (*PersistentTree[V], bool) {
+	key, bits := pkey(prefix)
+	next := *p
+	root := next.family(prefix.Addr().Is4())
+	var removed bool
+	*root, removed = pdelete(*root, &key, 0, bits)
+	if !removed {
+		return p, false
+	}
+	next.count(prefix, -1)
+	return &next, true
+}
+
+// withZone returns a version of the tree with z as the version of zone.
+func (p *PersistentTree[V]) withZone(zone string, z *PersistentTree[V]) *PersistentTree[V] {
+	next := *p
+	next.zones = maps.Clone(p.zones)
+	if next.zones == nil {
+		next.zones = make(map[string]*PersistentTree[V])
+	}
+	next.zones[zone] = z
+	return &next
+}
+
+// withOptions returns a version of the tree with the policies in opts.
+func (p *PersistentTree[V]) withOptions(opts options) *PersistentTree[V] {
+	next := *p
+	next.opts = opts
+	return &next
+}
+
+func (p *PersistentTree[V]) count(prefix netip.Prefix, delta int) {
+	if prefix.Addr().Is4() {
+		p.v4Len += delta
+	} else {
+		p.v6Len += delta
+	}
+}
+
+// pinsert returns a copy of the path from n to key/bits with v stored at its
+// end, and whether that added a new entry.
+func pinsert[V any](n *pnode[V], key *[16]byte, depth, bits int, v V) (*pnode[V], bool) {
+	c := new(pnode[V])
+	if n != nil {
+		*c = *n
+	}
+	if depth == bits {
+		added := !c.ok
+		c.value, c.ok = v, true
+		return c, added
+	}
+	var added bool
+	if keyBit(key, depth) {
+		c.right, added = pinsert(c.right, key, depth+1, bits, v)
+	} else {
+		c.left, added = pinsert(c.left, key, depth+1, bits, v)
+	}
+	return c, added
+}
+
+// pdelete returns n with the entry at key/bits removed, copying only the
+// nodes on the path to it and dropping nodes left without entries below them.
+func pdelete[V any](n *pnode[V], key *[16]byte, depth, bits int) (*pnode[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+	c := new(pnode[V])
+	*c = *n
+	if depth == bits {
+		if !n.ok {
+			return n, false
+		}
+		var zero V
+		c.value, c.ok = zero, false
+	} else {
+		var removed bool
+		if keyBit(key, depth) {
+			c.right, removed = pdelete(n.right, key, depth+1, bits)
+		} else {
+			c.left, removed = pdelete(n.left, key, depth+1, bits)
+		}
+		if !removed {
+			return n, false
+		}
+	}
+	if !c.ok && c.left == nil && c.right == nil {
+		return nil, true
+	}
+	return c, true
+}
+
+// put stores v at key/bits in place. It is only used while building a tree
+// that has not been published yet.
+func (p *PersistentTree[V]) put(prefix netip.Prefix, v V) {
+	key, bits := pkey(prefix)
+	n := p.family(prefix.Addr().Is4())
+	for depth := 0; ; depth++ {
+		if *n == nil {
+			*n = new(pnode[V])
+		}
+		if depth == bits {
+			break
+		}
+		if keyBit(&key, depth) {
+			n = &(*n).right
+		} else {
+			n = &(*n).left
+		}
+	}
+	if !(*n).ok {
+		p.count(prefix, 1)
+	}
+	(*n).value, (*n).ok = v, true
+}
+
+// pfind returns the node at depth bits along key below n, or nil.
+func pfind[V any](n *pnode[V], key *[16]byte, bits int) *pnode[V] {
+	for depth := 0; n != nil && depth < bits; depth++ {
+		if keyBit(key, depth) {
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return n
+}
+
+// plookup returns the node below n holding the longest entry covering prefix,
+// along with that entry's prefix.
+func plookup[V any](n *pnode[V], prefix netip.Prefix) (*pnode[V], netip.Prefix) {
+	key, bits := pkey(prefix)
+	var best *pnode[V]
+	bestDepth := 0
+	for depth := 0; n != nil; depth++ {
+		if n.ok {
+			best, bestDepth = n, depth
+		}
+		if depth == bits {
+			break
+		}
+		if keyBit(&key, depth) {
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if best == nil {
+		return nil, netip.Prefix{}
+	}
+	return best, pprefix(key, bestDepth, prefix.Addr().Is4())
+}
+
+// pcovering appends every entry below n covering prefix to matches, from the
+// least to the most specific.
+func pcovering[V any](n *pnode[V], prefix netip.Prefix, matches []Entry[V]) []Entry[V] {
+	key, bits := pkey(prefix)
+	for depth := 0; n != nil; depth++ {
+		if n.ok {
+			matches = append(matches, Entry[V]{Prefix: pprefix(key, depth, prefix.Addr().Is4()), Value: n.value})
+		}
+		if depth == bits {
+			break
+		}
+		if keyBit(&key, depth) {
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return matches
+}
+
+// lookup returns the node holding the longest entry covering prefix under the
+// mapped policy, along with that entry's prefix. A mapped prefix left alone
+// by the policy matches the IPv4 entries covering it first, and otherwise the
+// IPv6 entries covering ::ffff:0:0/96, as it does in a Tree.
+func (p *PersistentTree[V]) lookup(prefix netip.Prefix) (*pnode[V], netip.Prefix) {
+	prefix = p.opts.lookupPrefix(prefix)
+	if isMapped(prefix) {
+		if n, match := plookup(p.v4, normalizePrefix(prefix)); n != nil {
+			return n, match
+		}
+		prefix = netip.PrefixFrom(prefix.Addr(), v4Depth-1)
+	}
+	return plookup(*p.family(prefix.Addr().Is4()), prefix)
+}
+
+func (p *PersistentTree[V]) Get(ip net.IP) (V, bool, error) {
+	return p.GetNetIP(ip)
+}
+
+// GetByString returns the value of the longest prefix covering the given
+// address or CIDR.
+func (p *PersistentTree[V]) GetByString(ipstr string) (V, bool, error) {
+	v, _, found, err := p.GetWithPrefixByString(ipstr)
+	return v, found, err
+}
+
+func (p *PersistentTree[V]) GetIPNet(ip net.IPNet) (V, bool, error) {
+	prefix, err := ipNetLookup(ip)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	v, _, found := p.get(prefix, "")
+	return v, found, nil
+}
+
+func (p *PersistentTree[V]) GetNetIP(ip net.IP) (V, bool, error) {
+	v, _, found, err := p.GetWithPrefixNetIP(ip)
+	return v, found, err
+}
+
+// GetNetIPAddr returns the value of the longest prefix covering nip.
+func (p *PersistentTree[V]) GetNetIPAddr(nip netip.Addr) (V, bool, error) {
+	v, _, found, err := p.GetWithPrefixNetIPAddr(nip)
+	return v, found, err
+}
+
+// GetBatch looks up every address of addrs as Tree.GetBatch does.
+func (p *PersistentTree[V]) GetBatch(addrs []netip.Addr, out []V, found []bool) {
+	_, _ = out[:len(addrs)], found[:len(addrs)]
+	for k, addr := range addrs {
+		out[k], found[k], _ = p.GetNetIPAddr(addr)
+	}
+}
+
+// GetWithPrefixByString returns the value of the longest prefix covering the
+// given address or CIDR, along with that prefix.
+func (p *PersistentTree[V]) GetWithPrefixByString(ipstr string) (V, netip.Prefix, bool, error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	v, match, found := p.get(prefix, zone)
+	return v, match, found, nil
+}
+
+// GetWithPrefixNetIP returns the value of the longest prefix covering ip,
+// along with that prefix.
+func (p *PersistentTree[V]) GetWithPrefixNetIP(ip net.IP) (V, netip.Prefix, bool, error) {
+	nip, err := netIPAddr(ip)
+	if err != nil {
+		var zero V
+		return zero, netip.Prefix{}, false, err
+	}
+	return p.GetWithPrefixNetIPAddr(nip)
+}
+
+// GetWithPrefixNetIPAddr returns the value of the longest prefix covering nip,
+// along with that prefix.
+func (p *PersistentTree[V]) GetWithPrefixNetIPAddr(nip netip.Addr) (V, netip.Prefix, bool, error) {
+	if !nip.IsValid() {
+		var zero V
+		return zero, netip.Prefix{}, false, invalidPrefix(nip.String(), nil)
+	}
+	v, match, found := p.get(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+	return v, match, found, nil
+}
+
+func (p *PersistentTree[V]) get(prefix netip.Prefix, zone string) (V, netip.Prefix, bool) {
+	if z := p.scope(zone); z != nil {
+		if v, match, found := z.get(prefix, ""); found {
+			return v, match, found
+		}
+	}
+	n, match := p.lookup(prefix)
+	if n == nil {
+		var zero V
+		return zero, netip.Prefix{}, false
+	}
+	return n.value, match, true
+}
+
+// GetAllMatches returns every entry whose prefix contains nip, ordered from
+// the most to the least specific.
+func (p *PersistentTree[V]) GetAllMatches(nip netip.Addr) []Entry[V] {
+	if !nip.IsValid() {
+		return nil
+	}
+	return p.allMatches(netip.PrefixFrom(nip, nip.BitLen()), nip.Zone())
+}
+
+// GetAllMatchesByString returns every entry whose prefix contains the given
+// address or CIDR, ordered from the most to the least specific.
+func (p *PersistentTree[V]) GetAllMatchesByString(ipstr string) ([]Entry[V], error) {
+	prefix, zone, err := parseZoned(ipstr)
+	if err != nil {
+		return nil, err
+	}
+	return p.allMatches(prefix, zone), nil
+}
+
+func (p *PersistentTree[V]) allMatches(prefix netip.Prefix, zone string) []Entry[V] {
+	var matches []Entry[V]
+	lookup := p.opts.lookupPrefix(prefix)
+	if isMapped(lookup) {
+		matches = pcovering(p.v6, netip.PrefixFrom(lookup.Addr(), v4Depth-1), matches)
+		lookup = normalizePrefix(lookup)
+	}
+	matches = pcovering(*p.family(lookup.Addr().Is4()), lookup, matches)
+	slices.Reverse(matches)
+	if z := p.scope(zone); z != nil {
+		matches = append(z.allMatches(prefix, ""), matches...)
+	}
+	return matches
+}
+
+// GetExact returns the value stored for exactly prefix. Unlike the Get
+// family it does not fall back to a covering prefix.
+func (p *PersistentTree[V]) GetExact(prefix netip.Prefix) (V, bool) {
+	var zero V
+	prefix, ok := p.opts.entryPrefix(prefix)
+	if !prefix.IsValid() || !ok {
+		return zero, false
+	}
+	key, bits := pkey(prefix)
+	n := pfind(*p.family(prefix.Addr().Is4()), &key, bits)
+	if n == nil || !n.ok {
+		return zero, false
+	}
+	return n.value, true
+}
+
+// GetExactByString returns the value stored for exactly the given CIDR. A bare
+// address is treated as a host prefix.
+func (p *PersistentTree[V]) GetExactByString(ipcidr string) (V, bool, error) {
+	prefix, zone, err := parseZoned(ipcidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	t := p
+	if zone != "" && p.opts.zone == ZoneScoped {
+		if t = p.zones[zone]; t == nil {
+			var zero V
+			return zero, false, nil
+		}
+	}
+	v, found := t.GetExact(prefix)
+	return v, found, nil
+}
+
+// GetExactIPNet returns the value stored for exactly cidr.
+func (p *PersistentTree[V]) GetExactIPNet(cidr *net.IPNet) (V, bool, error) {
+	prefix, err := cidrPrefix(cidr)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	v, found := p.GetExact(prefix)
+	return v, found, nil
+}
+
+// HasPrefix reports whether exactly prefix is in the tree.
+func (p *PersistentTree[V]) HasPrefix(prefix netip.Prefix) bool {
+	_, found := p.GetExact(prefix)
+	return found
+}
+
+// HasPrefixByString reports whether exactly the given CIDR is in the tree.
+func (p *PersistentTree[V]) HasPrefixByString(ipcidr string) (bool, error) {
+	_, found, err := p.GetExactByString(ipcidr)
+	return found, err
+}
+
+// HasPrefixIPNet reports whether exactly cidr is in the tree.
+func (p *PersistentTree[V]) HasPrefixIPNet(cidr *net.IPNet) (bool, error) {
+	_, found, err := p.GetExactIPNet(cidr)
+	return found, err
+}
+
+// GetAll returns all entries in the tree as a map of CIDR strings to their
+// values.
+func (p *PersistentTree[V]) GetAll() map[string]V {
+	result := make(map[string]V, p.v4Len+p.v6Len)
+	for prefix, v := range p.All() {
+		result[prefix.String()] = v
+	}
+	return result
+}
+
+// All returns an iterator over every entry in the tree, IPv4 entries first,
+// each family in address order.
+func (p *PersistentTree[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		var key [16]byte
+		if !pwalk(p.v4, key, 0, true, yield) {
+			return
+		}
+		pwalk(p.v6, key, 0, false, yield)
+	}
+}
+
+// AllV4 returns an iterator over every IPv4 entry in address order.
+func (p *PersistentTree[V]) AllV4() iter.Seq2[netip.Prefix, V] {
+	return p.Within(allV4)
+}
+
+// AllV6 returns an iterator over every IPv6 entry in address order.
+func (p *PersistentTree[V]) AllV6() iter.Seq2[netip.Prefix, V] {
+	return p.Within(allV6)
+}
+
+// Within returns an iterator over every entry equal to or more specific than
+// prefix, in address order.
+func (p *PersistentTree[V]) Within(prefix netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		p.walkWithin(prefix, yield)
+	}
+}
+
+// walkWithin calls yield for every entry equal to or more specific than
+// prefix in address order, returning false once yield does.
+func (p *PersistentTree[V]) walkWithin(prefix netip.Prefix, yield func(netip.Prefix, V) bool) bool {
+	prefix, ok := p.opts.entryPrefix(prefix)
+	if !prefix.IsValid() || !ok {
+		return true
+	}
+	key, bits := pkey(prefix)
+	is4 := prefix.Addr().Is4()
+	return pwalk(pfind(*p.family(is4), &key, bits), key, bits, is4, yield)
+}
+
+// WalkWithin calls callback in address order for every entry whose prefix is
+// equal to or more specific than prefix. Iteration stops at the first error
+// returned by callback, which is returned unchanged.
+func (p *PersistentTree[V]) WalkWithin(prefix netip.Prefix, callback func(prefix netip.Prefix, value V) error) error {
+	if !prefix.IsValid() {
+		return invalidPrefix(prefix.String(), nil)
+	}
+	var err error
+	p.walkWithin(prefix, func(prefix netip.Prefix, v V) bool {
+		err = callback(prefix, v)
+		return err == nil
+	})
+	return err
+}
+
+// GetAllWithin returns every entry whose prefix is equal to or more specific
+// than prefix, in address order.
+func (p *PersistentTree[V]) GetAllWithin(prefix netip.Prefix) []Entry[V] {
+	var result []Entry[V]
+	for prefix, v := range p.Within(prefix) {
+		result = append(result, Entry[V]{Prefix: prefix, Value: v})
+	}
+	return result
+}
+
+// WalkV4Prefix calls callback for every IPv4 entry in address order, stopping
+// at the first error it returns.
+func (p *PersistentTree[V]) WalkV4Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return p.WalkWithin(allV4, callback)
+}
+
+// WalkV4String is WalkV4Prefix with the prefixes given as strings.
+func (p *PersistentTree[V]) WalkV4String(callback func(prefix string, value V) error) error {
+	return p.WalkWithin(allV4, func(prefix netip.Prefix, value V) error {
+		return callback(prefix.String(), value)
+	})
+}
+
+// WalkV6Prefix calls callback for every IPv6 entry in address order, stopping
+// at the first error it returns.
+func (p *PersistentTree[V]) WalkV6Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return p.WalkWithin(allV6, callback)
+}
+
+// WalkV6String is WalkV6Prefix with the prefixes given as strings.
+func (p *PersistentTree[V]) WalkV6String(callback func(prefix string, value V) error) error {
+	return p.WalkWithin(allV6, func(prefix netip.Prefix, value V) error {
+		return callback(prefix.String(), value)
+	})
+}
+
+// pwalk calls yield for every entry at or below n in address order, returning
+// false once yield does.
+func pwalk[V any](n *pnode[V], key [16]byte, depth int, is4 bool, yield func(netip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.ok && !yield(pprefix(key, depth, is4), n.value) {
+		return false
+	}
+	mask := byte(0x80 >> (depth % 8))
+	if n.left != nil {
+		key[depth/8] &^= mask
+		if !pwalk(n.left, key, depth+1, is4, yield) {
+			return false
+		}
+	}
+	if n.right != nil {
+		key[depth/8] |= mask
+		return pwalk(n.right, key, depth+1, is4, yield)
+	}
+	return true
+}
+
+// Tree returns a mutable Tree holding the entries, policies and zones of this
+// version. The Tree is built entry by entry, as the underlying nradix tree
+// allocates its own nodes, but starts out with this version as its snapshot,
+// so Snapshot on it returns at once. Like a Tree that Snapshot was called on,
+// it keeps its snapshot up to date until StopSnapshots is called.
+func (p *PersistentTree[V]) Tree() *Tree[V] {
+	t := p.tree()
+	t.opts = p.opts
+	for name, z := range p.zones {
+		t.setZone(name, z.Tree())
+	}
+	t.snap = p
+	return t
+}
+
+// tree returns a Tree with the default policies holding the entries of p
+// without a zone.
+func (p *PersistentTree[V]) tree() *Tree[V] {
+	t := NewTree[V]()
+	for prefix, v := range p.All() {
+		t.set(prefix, v, true)
+	}
+	return t
+}
+
+// Snapshot returns a PersistentTree holding the current entries, policies and
+// zones of the tree. The first call copies the whole tree. From then on the
+// tree keeps its snapshot up to date as it changes, so later calls take
+// constant time.
+//
+// Keeping the snapshot up to date has a cost for as long as it lasts: every
+// change also copies the path to the changed entry in the snapshot, and the
+// snapshot's nodes, about as many as the tree has, stay in memory alongside
+// the tree's. A tree that only needs an occasional snapshot, such as one taken
+// before a change to roll back to, should call StopSnapshots once it is done
+// with it.
+func (i *Tree[V]) Snapshot() *PersistentTree[V] {
+	if i.snap == nil {
+		p := i.snapshot()
+		for name, z := range i.zones {
+			if p.zones == nil {
+				p.zones = make(map[string]*PersistentTree[V])
+			}
+			p.zones[name] = z.Snapshot()
+		}
+		i.snap = p
+	}
+	return i.snap
+}
+
+// StopSnapshots stops keeping a snapshot up to date, ending the cost Snapshot
+// started. Snapshots already taken are not affected, and the next Snapshot
+// call copies the whole tree again. The snapshots of a zone's tree are part of
+// those of the tree holding the zone, so on a zone's tree it stops both.
+func (i *Tree[V]) StopSnapshots() {
+	for i.parent != nil {
+		i = i.parent
+	}
+	i.stopSnapshots()
+}
+
+func (i *Tree[V]) stopSnapshots() {
+	i.snap = nil
+	for _, z := range i.zones {
+		z.stopSnapshots()
+	}
+}
+
+// snapshot returns a new PersistentTree holding the entries of i without a
+// zone, which the caller may modify in place until it is published.
+func (i *Tree[V]) snapshot() *PersistentTree[V] {
+	p := &PersistentTree[V]{opts: i.opts}
+	for prefix, v := range i.All() {
+		p.put(prefix, v)
+	}
+	return p
+}
+
+// track makes p the snapshot of i, and updates the snapshot of the tree
+// holding i as a zone to match.
+func (i *Tree[V]) track(p *PersistentTree[V]) {
+	i.snap = p
+	if i.parent != nil && i.parent.snap != nil {
+		i.parent.track(i.parent.snap.withZone(i.name, p))
+	}
+}
+
+// record brings the snapshot of i, if one was taken, up to date with the entry
+// at prefix having been set to v, or removed if has is false.
+func (i *Tree[V]) record(prefix netip.Prefix, v V, has bool) {
+	if i.snap == nil {
+		return
+	}
+	if has {
+		i.track(i.snap.insert(prefix, v))
+	} else if next, removed := i.snap.delete(prefix); removed {
+		i.track(next)
+	}
+}
@@ -0,0 +1,227 @@
+package iptree
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("2001:db8::/32", 2)
+
+	c := ip.Clone()
+	c.AddByString("10.1.0.0/16", 3)
+	c.DeleteByString("2001:db8::/32")
+	ip.AddByString("10.0.0.0/8", 4)
+
+	if ip.Len() != 2 || ip.HasPrefix(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Errorf("Changing the clone changed the original: %v", ip.GetAll())
+	}
+	if val, _ := c.GetExact(netip.MustParsePrefix("10.0.0.0/8")); val != 1 {
+		t.Errorf("Changing the original changed the clone: %v", c.GetAll())
+	}
+	if c.Len() != 2 || c.LenV6() != 0 {
+		t.Errorf("Clone holds %d entries (%d IPv6)", c.Len(), c.LenV6())
+	}
+}
+
+func TestPersistentTree(t *testing.T) {
+	v0 := NewPersistentTree[string]()
+	v1 := v0.Insert(netip.MustParsePrefix("10.0.0.0/8"), "ten")
+	v2 := v1.Insert(netip.MustParsePrefix("10.1.0.0/16"), "ten-one")
+	v3, err := v2.InsertByString("2001:db8::/32", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, removed := v3.Delete(netip.MustParsePrefix("10.0.0.0/8"))
+	if !removed {
+		t.Error("Delete did not find 10.0.0.0/8")
+	}
+	if _, removed := v4.Delete(netip.MustParsePrefix("10.0.0.0/8")); removed {
+		t.Error("Delete removed a missing entry")
+	}
+
+	lens := []int{v0.Len(), v1.Len(), v2.Len(), v3.Len(), v4.Len()}
+	if !slices.Equal(lens, []int{0, 1, 2, 3, 2}) {
+		t.Errorf("Versions hold %v entries", lens)
+	}
+	if val, found, _ := v1.GetNetIPAddr(netip.MustParseAddr("10.1.2.3")); !found || val != "ten" {
+		t.Errorf("v1 lookup returned %q, %v", val, found)
+	}
+	if val, prefix, found, _ := v2.GetWithPrefixNetIPAddr(netip.MustParseAddr("10.1.2.3")); !found || val != "ten-one" || prefix.String() != "10.1.0.0/16" {
+		t.Errorf("v2 lookup returned %s=%q, %v", prefix, val, found)
+	}
+	mapped := netip.MustParseAddr("::ffff:10.1.2.3")
+	if val, prefix, found, _ := v2.GetWithPrefixNetIPAddr(mapped); !found || val != "ten-one" || prefix.String() != "10.1.0.0/16" {
+		t.Errorf("v2 lookup of %s returned %s=%q, %v", mapped, prefix, val, found)
+	}
+	if val, found, _ := v1.GetNetIPAddr(mapped); !found || val != "ten" {
+		t.Errorf("v1 lookup of %s returned %q, %v", mapped, val, found)
+	}
+	if _, found, _ := v4.GetNetIPAddr(netip.MustParseAddr("10.2.0.1")); found {
+		t.Error("v4 still holds the deleted 10.0.0.0/8")
+	}
+	if val, found, _ := v4.GetByString("2001:db8::1"); !found || val != "doc" {
+		t.Errorf("v4 IPv6 lookup returned %q, %v", val, found)
+	}
+	if !v3.HasPrefix(netip.MustParsePrefix("10.0.0.0/8")) || v4.HasPrefix(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Error("HasPrefix does not match the versions")
+	}
+
+	var visited []string
+	for prefix, v := range v3.All() {
+		visited = append(visited, prefix.String()+"="+v)
+	}
+	expected := []string{"10.0.0.0/8=ten", "10.1.0.0/16=ten-one", "2001:db8::/32=doc"}
+	if !slices.Equal(visited, expected) {
+		t.Errorf("All visited %v, expected %v", visited, expected)
+	}
+}
+
+func TestPersistentTreeSharing(t *testing.T) {
+	ip := NewTree[int]()
+	for n := 0; n < 256; n++ {
+		ip.AddByString(fmt.Sprintf("10.%d.0.0/16", n), n)
+	}
+	ip.AddByString("2001:db8::/32", 1)
+
+	v1 := ip.Snapshot()
+	if v1.Len() != ip.Len() || v1.LenV6() != 1 {
+		t.Fatalf("Snapshot holds %d entries, tree holds %d", v1.Len(), ip.Len())
+	}
+	v2 := v1.Insert(netip.MustParsePrefix("10.200.1.0/24"), 1000)
+
+	// Only the path to the new entry is copied; the 10.0.0.0/9 half of the
+	// tree and the IPv6 entries are shared between the versions.
+	if v1.v6 != v2.v6 {
+		t.Error("IPv6 nodes are not shared")
+	}
+	key, _ := pkey(netip.MustParsePrefix("10.0.0.0/8"))
+	n1, n2 := v1.v4, v2.v4
+	for depth := 0; depth < 8; depth++ {
+		if keyBit(&key, depth) {
+			n1, n2 = n1.right, n2.right
+		} else {
+			n1, n2 = n1.left, n2.left
+		}
+	}
+	if n1 == n2 || n1.left != n2.left || n1.right == n2.right {
+		t.Error("Only the modified path should be copied")
+	}
+
+	back := v2.Tree()
+	if back.Len() != 258 {
+		t.Errorf("Tree from snapshot holds %d entries", back.Len())
+	}
+	if val, _, _ := back.GetByString("10.200.1.1"); val != 1000 {
+		t.Errorf("Tree from snapshot returned %d", val)
+	}
+	if _, found := ip.GetExact(netip.MustParsePrefix("10.200.1.0/24")); found {
+		t.Error("Changing a snapshot changed the tree")
+	}
+}
+
+func TestSnapshotTracksChanges(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	v1 := ip.Snapshot()
+	if ip.Snapshot() != v1 {
+		t.Error("Snapshot of an unchanged tree made a new version")
+	}
+
+	ip.AddByString("10.1.0.0/16", 2)
+	ip.DeleteByString("10.0.0.0/8")
+	v2 := ip.Snapshot()
+	if v1.Len() != 1 || !v1.HasPrefix(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Errorf("Changing the tree changed an earlier snapshot: %v", v1.GetAll())
+	}
+	if v2.Len() != 1 || !v2.HasPrefix(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Errorf("Snapshot did not follow the tree: %v", v2.GetAll())
+	}
+
+	ip.AddByString("192.168.0.0/16", 3)
+	ip.AddByString("192.168.1.0/24", 4)
+	ip.DeleteSubtreeByString("192.168.0.0/16")
+	ip.Upsert(netip.MustParsePrefix("10.1.0.0/16"), func(old int, exists bool) int { return old + 10 })
+	if !maps.Equal(ip.Snapshot().GetAll(), ip.GetAll()) {
+		t.Errorf("Snapshot holds %v, tree holds %v", ip.Snapshot().GetAll(), ip.GetAll())
+	}
+
+	// Once stopped, changes no longer touch a snapshot, and the next one is
+	// taken afresh.
+	v3 := ip.Snapshot()
+	ip.StopSnapshots()
+	ip.AddByString("172.16.0.0/12", 5)
+	if ip.snap != nil || v3.Len() != 1 {
+		t.Error("StopSnapshots did not stop tracking")
+	}
+	if v4 := ip.Snapshot(); v4 == v3 || !maps.Equal(v4.GetAll(), ip.GetAll()) {
+		t.Errorf("Snapshot after StopSnapshots holds %v, tree holds %v", v4.GetAll(), ip.GetAll())
+	}
+
+	// Stopping from a zone's tree stops the tree holding it as well.
+	ip.SetZonePolicy(ZoneScoped)
+	ip.AddByString("fe80::%eth0/64", 6)
+	ip.Snapshot()
+	ip.Zone("eth0").StopSnapshots()
+	if ip.snap != nil || ip.Zone("eth0").snap != nil {
+		t.Error("StopSnapshots on a zone left tracking on")
+	}
+	ip.AddByString("fe80::%eth0/80", 7)
+	if v5 := ip.Snapshot(); v5.Zone("eth0").Len() != 2 {
+		t.Errorf("Snapshot after StopSnapshots holds %d entries in eth0", v5.Zone("eth0").Len())
+	}
+}
+
+func TestSnapshotPolicies(t *testing.T) {
+	ip := NewTree[int]()
+	ip.SetZonePolicy(ZoneScoped)
+	ip.AddByString("::/0", 1)
+	ip.AddByString("10.0.0.0/8", 2)
+	ip.AddByString("fe80::%eth0/64", 3)
+	v1 := ip.Snapshot()
+
+	// Entries added to a zone after the snapshot was taken reach the next one.
+	ip.AddByString("fe80::1%eth1", 4)
+	ip.SetMappedPolicy(MappedKeep)
+	v2 := ip.Snapshot()
+
+	if v1.Len() != 3 || v2.Len() != 4 || !slices.Equal(v2.Zones(), []string{"eth0", "eth1"}) {
+		t.Errorf("Snapshots hold %d and %d entries in zones %v", v1.Len(), v2.Len(), v2.Zones())
+	}
+	if val, _, _ := v2.GetByString("fe80::1%eth0"); val != 3 {
+		t.Errorf("Zone-scoped lookup returned %d", val)
+	}
+	if val, _, _ := v2.GetByString("fe80::1"); val != 1 {
+		t.Errorf("Lookup without a zone returned %d", val)
+	}
+	mapped := netip.MustParseAddr("::ffff:10.1.1.1")
+	if val, _, _ := v1.GetNetIPAddr(mapped); val != 2 {
+		t.Errorf("Mapped lookup under MappedMatchBoth returned %d", val)
+	}
+	if val, _, _ := v2.GetNetIPAddr(mapped); val != 1 {
+		t.Errorf("Mapped lookup under MappedKeep returned %d", val)
+	}
+	if matches := v1.GetAllMatches(mapped); len(matches) != 2 || matches[0].Value != 2 || matches[1].Value != 1 {
+		t.Errorf("GetAllMatches returned %v", matches)
+	}
+
+	back := v2.Tree()
+	for _, s := range []string{"fe80::1%eth0", "fe80::1%eth1", "fe80::1", "::ffff:10.1.1.1"} {
+		want, _, _ := ip.GetByString(s)
+		if got, _, _ := back.GetByString(s); got != want {
+			t.Errorf("Round trip changed the lookup of %s from %d to %d", s, want, got)
+		}
+	}
+	if back.Snapshot() != v2 {
+		t.Error("Tree from a snapshot does not start out with it")
+	}
+	back.AddByString("fe80::2%eth1", 5)
+	if v2.Len() != 4 || back.Snapshot().Len() != 5 {
+		t.Error("Changing the tree from a snapshot changed the snapshot")
+	}
+}
@@ -0,0 +1,140 @@
+package iptree
+
+import "net/netip"
+
+// HostBitsPolicy decides what adding a prefix with bits set beyond its mask,
+// such as 1.2.3.4/24, does.
+type HostBitsPolicy int
+
+const (
+	// HostBitsMask stores the masked prefix, 1.2.3.0/24. It is the default.
+	HostBitsMask HostBitsPolicy = iota
+	// HostBitsReject leaves the tree alone and returns ErrHostBitsSet.
+	HostBitsReject
+	// HostBitsWarn stores the masked prefix after passing both prefixes to
+	// the warning function given to SetHostBitsPolicy.
+	HostBitsWarn
+)
+
+// MappedPolicy decides how IPv4-mapped IPv6 addresses and prefixes, such as
+// ::ffff:1.2.3.4 from a dual-stack socket, are treated. The underlying tree
+// stores IPv4 entries at their mapped addresses, so a mapped prefix of /96 or
+// longer can only ever be stored as the IPv4 prefix it maps.
+//
+// The policy applies to netip.Addr, netip.Prefix and string arguments. A
+// net.IP holding an IPv4 address in its 16 byte form is always IPv4, as the
+// net package cannot tell it apart from a mapped address.
+type MappedPolicy int
+
+const (
+	// MappedMatchBoth stores mapped prefixes as IPv4. Lookups of mapped
+	// addresses match IPv4 entries and fall back to the IPv6 entries covering
+	// the mapped address, such as ::/0. It is the default.
+	MappedMatchBoth MappedPolicy = iota
+	// MappedUnmap treats mapped addresses and prefixes as their IPv4 form
+	// everywhere, so they only ever match IPv4 entries.
+	MappedUnmap
+	// MappedKeep treats mapped addresses and prefixes as IPv6, so they never
+	// match IPv4 entries. Adding a mapped prefix of /96 or longer fails with
+	// ErrInvalidPrefix, and deleting or walking one finds nothing.
+	MappedKeep
+)
+
+// options holds the policies set on a Tree. They are carried over by Clone and
+// Compact.
+type options struct {
+	hostBits     HostBitsPolicy
+	hostBitsWarn func(given, masked netip.Prefix)
+	mapped       MappedPolicy
+	zone         ZonePolicy
+}
+
+// SetHostBitsPolicy sets how every add method, including Upsert, treats
+// prefixes with host bits set. warn is only called under HostBitsWarn.
+func (i *Tree[V]) SetHostBitsPolicy(policy HostBitsPolicy, warn func(given, masked netip.Prefix)) {
+	opts := i.opts
+	opts.hostBits, opts.hostBitsWarn = policy, warn
+	i.setOptions(opts)
+}
+
+// checkHostBits applies the host bits policy to a prefix about to be added.
+func (o options) checkHostBits(prefix netip.Prefix) error {
+	masked := prefix.Masked()
+	if masked == prefix {
+		return nil
+	}
+	switch o.hostBits {
+	case HostBitsReject:
+		return &PrefixError{Op: "add", Input: prefix.String(), Err: ErrHostBitsSet}
+	case HostBitsWarn:
+		if o.hostBitsWarn != nil {
+			o.hostBitsWarn(prefix, masked)
+		}
+	}
+	return nil
+}
+
+// SetMappedPolicy sets how IPv4-mapped IPv6 addresses and prefixes are added,
+// looked up, deleted and walked.
+func (i *Tree[V]) SetMappedPolicy(policy MappedPolicy) {
+	opts := i.opts
+	opts.mapped = policy
+	i.setOptions(opts)
+}
+
+// isMapped reports whether prefix is an IPv4-mapped prefix inside the part of
+// the tree holding IPv4 entries.
+func isMapped(prefix netip.Prefix) bool {
+	return prefix.Addr().Is4In6() && prefix.Bits() >= v4Depth
+}
+
+func (i *Tree[V]) lookupPrefix(prefix netip.Prefix) netip.Prefix {
+	return i.opts.lookupPrefix(prefix)
+}
+
+// lookupPrefix applies the mapped policy to a prefix whose covering entries
+// are about to be looked up.
+func (o options) lookupPrefix(prefix netip.Prefix) netip.Prefix {
+	if !isMapped(prefix) {
+		return prefix
+	}
+	switch o.mapped {
+	case MappedUnmap:
+		return normalizePrefix(prefix)
+	case MappedKeep:
+		// Stop above ::ffff:0:0/96, which holds the IPv4 0.0.0.0/0 entry.
+		return netip.PrefixFrom(prefix.Addr(), v4Depth-1)
+	}
+	return prefix
+}
+
+func (i *Tree[V]) addPrefix(prefix netip.Prefix) (netip.Prefix, error) {
+	return i.opts.addPrefix(prefix)
+}
+
+// addPrefix applies the host bits and mapped policies to a prefix about to be
+// added, returning the prefix its entry is stored at.
+func (o options) addPrefix(prefix netip.Prefix) (netip.Prefix, error) {
+	if err := o.checkHostBits(prefix); err != nil {
+		return prefix, err
+	}
+	prefix, ok := o.entryPrefix(prefix)
+	if !ok {
+		return prefix, &PrefixError{Op: "add", Input: prefix.String(), Err: ErrInvalidPrefix}
+	}
+	return prefix, nil
+}
+
+func (i *Tree[V]) entryPrefix(prefix netip.Prefix) (netip.Prefix, bool) {
+	return i.opts.entryPrefix(prefix)
+}
+
+// entryPrefix applies the mapped policy to a prefix naming an entry, or the
+// entries below it, returning the normalized prefix and false if under the
+// policy it cannot name any entry.
+func (o options) entryPrefix(prefix netip.Prefix) (netip.Prefix, bool) {
+	if isMapped(prefix) && o.mapped == MappedKeep {
+		return prefix, false
+	}
+	return normalizePrefix(prefix), true
+}
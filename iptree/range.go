@@ -0,0 +1,239 @@
+package iptree
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/iqhive/nradix"
+)
+
+// AddRange stores v for every address from from to to inclusive, using the
+// smallest set of CIDRs that covers exactly that range.
+func (i *Tree[V]) AddRange(from, to netip.Addr, v V) error {
+	return i.addRange(from, to, v, true)
+}
+
+// AddRangeIfAbsent is AddRange without overwriting: if any CIDR of the range
+// is already in the tree nothing is added and ErrExists is returned.
+func (i *Tree[V]) AddRangeIfAbsent(from, to netip.Addr, v V) error {
+	return i.addRange(from, to, v, false)
+}
+
+func (i *Tree[V]) addRange(from, to netip.Addr, v V, overwrite bool) error {
+	prefixes, err := RangePrefixes(from, to)
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		for _, prefix := range prefixes {
+			if i.HasPrefix(prefix) {
+				return exists(prefix.String())
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		if err := i.set(prefix, v, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RangePrefixes returns the smallest set of CIDRs covering exactly the
+// addresses from from to to inclusive, in address order. Both addresses must
+// be of the same family, and from must not come after to.
+func RangePrefixes(from, to netip.Addr) ([]netip.Prefix, error) {
+	if !from.IsValid() || !to.IsValid() || from.BitLen() != to.BitLen() || to.Less(from) {
+		return nil, &PrefixError{Op: "range", Input: from.String() + "-" + to.String(), Err: ErrInvalidRange}
+	}
+	from, to = from.WithZone(""), to.WithZone("")
+	var prefixes []netip.Prefix
+	for {
+		// Widen the prefix starting at from for as long as it stays aligned
+		// and inside the range.
+		bits := from.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(from, bits-1)
+			if wider.Masked().Addr() != from || to.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(from, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == to {
+			return prefixes, nil
+		}
+		from = last.Next()
+	}
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	key, bits := treeKey(prefix.Masked())
+	for depth := bits; depth < 128; depth++ {
+		key[depth/8] |= 0x80 >> (depth % 8)
+	}
+	addr := netip.AddrFrom16(key)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// isRange reports whether s is written as an address range rather than a
+// CIDR or address. Dashes after a % belong to a zone, as in fe80::1%br-lan.
+func isRange(s string) bool {
+	dash := strings.IndexByte(s, '-')
+	if dash < 0 {
+		return false
+	}
+	zone := strings.IndexByte(s, '%')
+	return zone < 0 || dash < zone
+}
+
+// parseRange parses an address range written as first-last, such as
+// 1.2.3.4-1.2.5.17. Spaces around the dash are allowed.
+func parseRange(s string) (from, to netip.Addr, err error) {
+	first, last, _ := strings.Cut(s, "-")
+	if from, err = netip.ParseAddr(strings.TrimSpace(first)); err != nil {
+		return netip.Addr{}, netip.Addr{}, &PrefixError{Op: "parse", Input: s, Err: ErrInvalidRange, cause: err}
+	}
+	if to, err = netip.ParseAddr(strings.TrimSpace(last)); err != nil {
+		return netip.Addr{}, netip.Addr{}, &PrefixError{Op: "parse", Input: s, Err: ErrInvalidRange, cause: err}
+	}
+	return from, to, nil
+}
+
+// Range is a contiguous block of addresses from From to To inclusive that all
+// share the same value.
+type Range[V any] struct {
+	From, To netip.Addr
+	Value    V
+}
+
+// Ranges returns the addresses covered by the tree as non-overlapping ranges
+// in address order, IPv4 first, each holding the value a lookup of its
+// addresses returns. Adjacent ranges are merged when equal reports their
+// values equal, and never when equal is nil.
+//
+// Under MappedMatchBoth and MappedUnmap the IPv4 ranges show up a second time
+// in the IPv6 ranges, at their IPv4-mapped addresses, as lookups of mapped
+// addresses find the IPv4 entries. Under MappedMatchBoth the rest of
+// ::ffff:0:0/96 keeps the value of the IPv6 entry covering it; under
+// MappedUnmap it is not covered.
+func (i *Tree[V]) Ranges(equal func(a, b V) bool) []Range[V] {
+	v4 := i.familyRanges(allV4, equal)
+	v6 := i.familyRanges(allV6, equal)
+	if i.opts.mapped != MappedKeep {
+		v6 = i.mappedRanges(v4, v6, equal)
+	}
+	return append(v4, v6...)
+}
+
+// appendRange appends r to ranges, merging it into the last range when it
+// follows on from it and equal reports their values equal.
+func appendRange[V any](ranges []Range[V], r Range[V], equal func(a, b V) bool) []Range[V] {
+	if k := len(ranges) - 1; k >= 0 && equal != nil && ranges[k].To.Next() == r.From && equal(ranges[k].Value, r.Value) {
+		ranges[k].To = r.To
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+// familyRanges returns the ranges of the entries within family, which is
+// allV4 or allV6.
+func (i *Tree[V]) familyRanges(family netip.Prefix, equal func(a, b V) bool) []Range[V] {
+	var ranges []Range[V]
+	emit := func(n *nradix.Node, from, to netip.Addr) {
+		ranges = appendRange(ranges, Range[V]{From: from, To: to, Value: n.GetValue().(V)}, equal)
+	}
+
+	type open struct {
+		n    *nradix.Node
+		last netip.Addr
+	}
+	// Entries arrive ordered by first address with covering prefixes first.
+	// next is the first address not yet emitted, and stack holds the entries
+	// covering it from the least to the most specific.
+	var next netip.Addr
+	var stack []open
+	// closeBefore emits what is left of the innermost entries ending before
+	// addr, or of all of them if addr is not valid.
+	closeBefore := func(addr netip.Addr) {
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if addr.IsValid() && !top.last.Less(addr) {
+				break
+			}
+			if next.IsValid() && !top.last.Less(next) {
+				emit(top.n, next, top.last)
+				next = top.last.Next()
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	_ = i.walkWithin(family, func(n *nradix.Node, prefix netip.Prefix) error {
+		if _, ok := n.GetValue().(V); !ok {
+			return nil
+		}
+		first := prefix.Addr()
+		closeBefore(first)
+		if len(stack) > 0 && next.Less(first) {
+			emit(stack[len(stack)-1].n, next, first.Prev())
+		}
+		stack = append(stack, open{n: n, last: lastAddr(prefix)})
+		next = first
+		return nil
+	})
+	closeBefore(netip.Addr{})
+	return ranges
+}
+
+// mappedRanges returns the IPv6 ranges v6 with ::ffff:0:0/96 laid out as
+// lookups of mapped addresses see it: the IPv4 ranges v4 at their mapped
+// addresses and, under MappedMatchBoth, the IPv6 range covering the block in
+// between.
+func (i *Tree[V]) mappedRanges(v4, v6 []Range[V], equal func(a, b V) bool) []Range[V] {
+	mapped := func(addr netip.Addr) netip.Addr {
+		return netip.AddrFrom16(addr.As16())
+	}
+	block := netip.PrefixFrom(mapped(netip.IPv4Unspecified()), v4Depth)
+	first, last := block.Addr(), lastAddr(block)
+
+	out := make([]Range[V], 0, len(v6)+len(v4)+2)
+	k := 0
+	for ; k < len(v6) && v6[k].To.Less(first); k++ {
+		out = append(out, v6[k])
+	}
+	// No IPv6 entry lies inside the block, so at most one range reaches into
+	// it, and that one covers all of it.
+	var covering *Range[V]
+	if k < len(v6) && !last.Less(v6[k].From) {
+		covering = &v6[k]
+		k++
+		if covering.From.Less(first) {
+			out = appendRange(out, Range[V]{From: covering.From, To: first.Prev(), Value: covering.Value}, equal)
+		}
+	}
+	fill := func(from, to netip.Addr) {
+		if covering != nil && i.opts.mapped == MappedMatchBoth && !to.Less(from) {
+			out = appendRange(out, Range[V]{From: from, To: to, Value: covering.Value}, equal)
+		}
+	}
+	next := first
+	for _, r := range v4 {
+		from := mapped(r.From)
+		if next.Less(from) {
+			fill(next, from.Prev())
+		}
+		out = appendRange(out, Range[V]{From: from, To: mapped(r.To), Value: r.Value}, equal)
+		next = mapped(r.To).Next()
+	}
+	fill(next, last)
+	if covering != nil && last.Less(covering.To) {
+		out = appendRange(out, Range[V]{From: last.Next(), To: covering.To, Value: covering.Value}, equal)
+	}
+	return append(out, v6[k:]...)
+}
@@ -0,0 +1,197 @@
+package iptree
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		from, to string
+		expected []string
+	}{
+		{"1.2.3.4", "1.2.5.17", []string{"1.2.3.4/30", "1.2.3.8/29", "1.2.3.16/28", "1.2.3.32/27", "1.2.3.64/26", "1.2.3.128/25", "1.2.4.0/24", "1.2.5.0/28", "1.2.5.16/31"}},
+		{"10.0.0.0", "10.255.255.255", []string{"10.0.0.0/8"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"192.168.1.1", "192.168.1.1", []string{"192.168.1.1/32"}},
+		{"2001:db8::", "2001:db8::1:ffff", []string{"2001:db8::/111"}},
+		{"2001:db8::ffff", "2001:db8::1:0", []string{"2001:db8::ffff/128", "2001:db8::1:0/128"}},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+	}
+	for _, test := range tests {
+		prefixes, err := RangePrefixes(netip.MustParseAddr(test.from), netip.MustParseAddr(test.to))
+		if err != nil {
+			t.Errorf("RangePrefixes(%s, %s) failed: %v", test.from, test.to, err)
+			continue
+		}
+		var got []string
+		for _, prefix := range prefixes {
+			got = append(got, prefix.String())
+		}
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("RangePrefixes(%s, %s) returned %v, expected %v", test.from, test.to, got, test.expected)
+		}
+	}
+
+	for _, bad := range [][2]string{{"1.2.3.5", "1.2.3.4"}, {"1.2.3.4", "::1"}} {
+		if _, err := RangePrefixes(netip.MustParseAddr(bad[0]), netip.MustParseAddr(bad[1])); err == nil {
+			t.Errorf("Expected error for range %s-%s", bad[0], bad[1])
+		}
+	}
+}
+
+func TestAddRange(t *testing.T) {
+	ip := NewTree[int]()
+	if err := ip.AddByString("1.2.3.4-1.2.5.17", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.AddByString("2001:db8::10 - 2001:db8::1f", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ip.AddRange(netip.MustParseAddr("10.0.0.0"), netip.MustParseAddr("10.0.1.255"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if ip.Len() != 11 {
+		t.Errorf("Expected 11 entries, found %d", ip.Len())
+	}
+	for addr, expected := range map[string]int{
+		"1.2.3.4": 1, "1.2.4.200": 1, "1.2.5.17": 1,
+		"1.2.3.3": 0, "1.2.5.18": 0,
+		"2001:db8::10": 2, "2001:db8::1f": 2, "2001:db8::20": 0,
+		"10.0.1.1": 3,
+	} {
+		val, found, err := ip.GetByString(addr)
+		if err != nil || val != expected || found != (expected != 0) {
+			t.Errorf("Lookup of %s returned %d, %v, %v; expected %d", addr, val, found, err, expected)
+		}
+	}
+
+	for _, bad := range []string{"1.2.3.4-", "1.2.3.4-1.2.3.0", "1.2.3.4-::1", "1.2.3.4-1.2.3.x"} {
+		if err := ip.AddByString(bad, 1); err == nil {
+			t.Errorf("Expected error adding %q", bad)
+		}
+	}
+	if ip.Len() != 11 {
+		t.Errorf("Failed adds changed the tree")
+	}
+}
+
+func TestRanges(t *testing.T) {
+	ip := NewTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("10.1.0.0/16", 2)
+	ip.AddByString("10.1.0.0/24", 1)
+	ip.AddByString("10.1.2.0/24", 2)
+	ip.AddByString("11.0.0.0/8", 1)
+	ip.AddByString("255.255.255.255/32", 3)
+	ip.AddByString("2001:db8::/32", 4)
+	ip.AddByString("2001:db8::/48", 5)
+
+	format := func(ranges []Range[int]) []string {
+		var result []string
+		for _, r := range ranges {
+			result = append(result, fmt.Sprintf("%s-%s=%d", r.From, r.To, r.Value))
+		}
+		return result
+	}
+
+	got := format(ip.Ranges(nil))
+	expected := []string{
+		"10.0.0.0-10.0.255.255=1",
+		"10.1.0.0-10.1.0.255=1",
+		"10.1.1.0-10.1.1.255=2",
+		"10.1.2.0-10.1.2.255=2",
+		"10.1.3.0-10.1.255.255=2",
+		"10.2.0.0-10.255.255.255=1",
+		"11.0.0.0-11.255.255.255=1",
+		"255.255.255.255-255.255.255.255=3",
+		"::ffff:10.0.0.0-::ffff:10.0.255.255=1",
+		"::ffff:10.1.0.0-::ffff:10.1.0.255=1",
+		"::ffff:10.1.1.0-::ffff:10.1.1.255=2",
+		"::ffff:10.1.2.0-::ffff:10.1.2.255=2",
+		"::ffff:10.1.3.0-::ffff:10.1.255.255=2",
+		"::ffff:10.2.0.0-::ffff:10.255.255.255=1",
+		"::ffff:11.0.0.0-::ffff:11.255.255.255=1",
+		"::ffff:255.255.255.255-::ffff:255.255.255.255=3",
+		"2001:db8::-2001:db8:0:ffff:ffff:ffff:ffff:ffff=5",
+		"2001:db8:1::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff=4",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Ranges(nil) returned %v, expected %v", got, expected)
+	}
+
+	got = format(ip.Ranges(Equal[int]))
+	expected = []string{
+		"10.0.0.0-10.1.0.255=1",
+		"10.1.1.0-10.1.255.255=2",
+		"10.2.0.0-11.255.255.255=1",
+		"255.255.255.255-255.255.255.255=3",
+		"::ffff:10.0.0.0-::ffff:10.1.0.255=1",
+		"::ffff:10.1.1.0-::ffff:10.1.255.255=2",
+		"::ffff:10.2.0.0-::ffff:11.255.255.255=1",
+		"::ffff:255.255.255.255-::ffff:255.255.255.255=3",
+		"2001:db8::-2001:db8:0:ffff:ffff:ffff:ffff:ffff=5",
+		"2001:db8:1::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff=4",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Ranges(Equal) returned %v, expected %v", got, expected)
+	}
+
+	if ranges := NewTree[int]().Ranges(nil); len(ranges) != 0 {
+		t.Errorf("Ranges of an empty tree returned %v", ranges)
+	}
+}
+
+func TestRangesMapped(t *testing.T) {
+	for _, policy := range []MappedPolicy{MappedMatchBoth, MappedUnmap, MappedKeep} {
+		ip := NewTree[int]()
+		ip.SetMappedPolicy(policy)
+		ip.AddByString("::/0", 1)
+		ip.AddByString("10.0.0.0/8", 2)
+		ip.AddByString("11.0.0.0/8", 1)
+
+		// Every range holds what lookups of its first and last address
+		// return, and the gaps between ranges are not covered.
+		var prev, mapped netip.Addr
+		for _, r := range ip.Ranges(Equal[int]) {
+			for _, addr := range []netip.Addr{r.From, r.To} {
+				if val, found, _ := ip.GetNetIPAddr(addr); !found || val != r.Value {
+					t.Errorf("Policy %d: range %s-%s=%d, lookup of %s returned %d, %v", policy, r.From, r.To, r.Value, addr, val, found)
+				}
+			}
+			if prev.IsValid() && prev.Is6() && prev.Next() != r.From {
+				if _, found, _ := ip.GetNetIPAddr(prev.Next()); found {
+					t.Errorf("Policy %d: %s is found but in no range", policy, prev.Next())
+				}
+			}
+			prev = r.To
+			if r.From.Is4In6() {
+				mapped = r.From
+			}
+		}
+		if policy == MappedKeep && mapped.IsValid() {
+			t.Errorf("Policy %d: a range starts inside ::ffff:0:0/96 at %s", policy, mapped)
+		}
+	}
+
+	ip := NewTree[int]()
+	ip.AddByString("::/0", 1)
+	ip.AddByString("10.0.0.0/8", 2)
+	var got []string
+	for _, r := range ip.Ranges(nil) {
+		got = append(got, fmt.Sprintf("%s-%s=%d", r.From, r.To, r.Value))
+	}
+	expected := []string{
+		"10.0.0.0-10.255.255.255=2",
+		"::-::fffe:ffff:ffff=1",
+		"::ffff:0.0.0.0-::ffff:9.255.255.255=1",
+		"::ffff:10.0.0.0-::ffff:10.255.255.255=2",
+		"::ffff:11.0.0.0-::ffff:255.255.255.255=1",
+		"::1:0:0:0-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff=1",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Ranges(nil) returned %v, expected %v", got, expected)
+	}
+}
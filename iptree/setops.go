@@ -0,0 +1,179 @@
+package iptree
+
+import (
+	"github.com/iqhive/nradix"
+)
+
+// Union returns a tree covering every address covered by either tree. Where
+// both trees cover an address the value is merge(i's value, other's value).
+// If merge is nil the more specific of the two matches wins, and other's
+// value on equal prefixes, as if other's entries were added to a copy of i.
+func (i *Tree[V]) Union(other *Tree[V], merge func(a, b V) V) *Tree[V] {
+	return combine(i, other, func(a, b *nradix.Node) (V, bool) {
+		switch {
+		case a != nil && b != nil:
+			if merge == nil {
+				if a.GetPrefix().Bits() > b.GetPrefix().Bits() {
+					return a.GetValue().(V), true
+				}
+				return b.GetValue().(V), true
+			}
+			return merge(a.GetValue().(V), b.GetValue().(V)), true
+		case a != nil:
+			return a.GetValue().(V), true
+		case b != nil:
+			return b.GetValue().(V), true
+		}
+		var zero V
+		return zero, false
+	})
+}
+
+// Intersect returns a tree covering the addresses covered by both trees, with
+// the value merge(i's value, other's value), or i's value if merge is nil.
+// Prefixes only partly covered by the other tree are split into the CIDRs
+// that are.
+func (i *Tree[V]) Intersect(other *Tree[V], merge func(a, b V) V) *Tree[V] {
+	return combine(i, other, func(a, b *nradix.Node) (V, bool) {
+		if a == nil || b == nil {
+			var zero V
+			return zero, false
+		}
+		if merge == nil {
+			return a.GetValue().(V), true
+		}
+		return merge(a.GetValue().(V), b.GetValue().(V)), true
+	})
+}
+
+// Difference returns a tree covering the addresses covered by i but not by
+// other, with i's values. Prefixes partly covered by other are split into the
+// smallest set of CIDRs covering the remainder, so 10.0.0.0/8 minus
+// 10.1.0.0/16 yields 10.0.0.0/16, 10.2.0.0/15, 10.4.0.0/14 and so on.
+func (i *Tree[V]) Difference(other *Tree[V]) *Tree[V] {
+	return combine(i, other, func(a, b *nradix.Node) (V, bool) {
+		if a == nil || b != nil {
+			var zero V
+			return zero, false
+		}
+		return a.GetValue().(V), true
+	})
+}
+
+// combineFunc returns the result for addresses whose longest matches in the
+// two trees are the nodes a and b, either of which may be nil.
+type combineFunc[V any] func(a, b *nradix.Node) (V, bool)
+
+// region is a position in the overlay of two trees. Leaves are regions over
+// which neither tree changes, so the result is uniform across them.
+type region struct {
+	left, right *region
+	a, b        *nradix.Node // longest matches covering the whole region
+	hole        bool         // the result is undefined somewhere in the region
+}
+
+func (r *region) leaf() bool {
+	return r.left == nil && r.right == nil
+}
+
+// combine builds the tree holding op applied to every address of a and b.
+func combine[V any](a, b *Tree[V], op combineFunc[V]) *Tree[V] {
+	result := NewTree[V]()
+	for _, is4 := range []bool{true, false} {
+		na, depth := a.start(is4)
+		nb, _ := b.start(is4)
+		var key [16]byte
+		if is4 {
+			key = v4Key
+		}
+		r := overlay(na, nb, key, depth, is4, nil, nil, op)
+		emit(result, r, key, depth, is4, nil, nil, false, op)
+	}
+	return result
+}
+
+// overlay walks a and b together from depth along key, recording the longest
+// matches of each region and whether op leaves any of it uncovered.
+func overlay[V any](a, b *nradix.Node, key [16]byte, depth int, is4 bool, ma, mb *nradix.Node, op combineFunc[V]) *region {
+	if !is4 && depth == v4Depth && isV4Space(&key) {
+		// The IPv4 entries are not part of the IPv6 family.
+		a, b = nil, nil
+	}
+	if a != nil {
+		if _, ok := a.GetValue().(V); ok {
+			ma = a
+		}
+	}
+	if b != nil {
+		if _, ok := b.GetValue().(V); ok {
+			mb = b
+		}
+	}
+	r := &region{a: ma, b: mb}
+	if depth == 128 || (!hasChildren(a) && !hasChildren(b)) {
+		_, defined := op(ma, mb)
+		r.hole = !defined
+		return r
+	}
+
+	mask := byte(0x80 >> (depth % 8))
+	key[depth/8] &^= mask
+	r.left = overlay(left(a), left(b), key, depth+1, is4, ma, mb, op)
+	key[depth/8] |= mask
+	r.right = overlay(right(a), right(b), key, depth+1, is4, ma, mb, op)
+
+	// Collapse structure that changes nothing, such as the path to the IPv4
+	// entries in the IPv6 family.
+	if r.left.leaf() && r.right.leaf() && r.left.a == r.right.a && r.left.b == r.right.b {
+		r.left, r.right = nil, nil
+	}
+	if r.leaf() {
+		_, defined := op(ma, mb)
+		r.hole = !defined
+	} else {
+		r.hole = r.left.hole || r.right.hole
+	}
+	return r
+}
+
+// emit adds the entries for region r to result. An entry is added for a
+// region only when no enclosing entry already provides its result, and
+// regions containing holes are split so no entry covers an uncovered address.
+func emit[V any](result *Tree[V], r *region, key [16]byte, depth int, is4 bool, ca, cb *nradix.Node, covered bool, op combineFunc[V]) {
+	v, defined := op(r.a, r.b)
+	if defined && !r.hole {
+		if !covered || ca != r.a || cb != r.b {
+			result.set(keyPrefix(key, depth, is4), v, true)
+		}
+		ca, cb, covered = r.a, r.b, true
+	} else {
+		covered = false
+	}
+	if r.leaf() {
+		return
+	}
+
+	mask := byte(0x80 >> (depth % 8))
+	key[depth/8] &^= mask
+	emit(result, r.left, key, depth+1, is4, ca, cb, covered, op)
+	key[depth/8] |= mask
+	emit(result, r.right, key, depth+1, is4, ca, cb, covered, op)
+}
+
+func hasChildren(n *nradix.Node) bool {
+	return n != nil && (n.GetLeft() != nil || n.GetRight() != nil)
+}
+
+func left(n *nradix.Node) *nradix.Node {
+	if n == nil {
+		return nil
+	}
+	return n.GetLeft()
+}
+
+func right(n *nradix.Node) *nradix.Node {
+	if n == nil {
+		return nil
+	}
+	return n.GetRight()
+}
@@ -0,0 +1,103 @@
+package iptree
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func treeOf(t *testing.T, entries map[string]int) *Tree[int] {
+	t.Helper()
+	tree := NewTree[int]()
+	for cidr, v := range entries {
+		if err := tree.AddByString(cidr, v); err != nil {
+			t.Fatalf("failed to insert CIDR %s: %v", cidr, err)
+		}
+	}
+	return tree
+}
+
+func entriesOf(tree *Tree[int]) []string {
+	var entries []string
+	for prefix, v := range tree.All() {
+		entries = append(entries, prefix.String()+"="+strconv.Itoa(v))
+	}
+	return entries
+}
+
+func TestDifference(t *testing.T) {
+	a := treeOf(t, map[string]int{"10.0.0.0/8": 1, "2001:db8::/32": 2})
+	b := treeOf(t, map[string]int{"10.1.0.0/16": 9, "2001:db8:8000::/33": 9})
+
+	got := entriesOf(a.Difference(b))
+	expected := []string{
+		"10.0.0.0/16=1", "10.2.0.0/15=1", "10.4.0.0/14=1", "10.8.0.0/13=1",
+		"10.16.0.0/12=1", "10.32.0.0/11=1", "10.64.0.0/10=1", "10.128.0.0/9=1",
+		"2001:db8::/33=2",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Difference returned %v, expected %v", got, expected)
+	}
+
+	// Nested entries in the first tree are kept as they are where nothing
+	// is removed from them.
+	a = treeOf(t, map[string]int{"10.0.0.0/8": 1, "10.1.0.0/16": 2, "192.168.0.0/16": 3})
+	b = treeOf(t, map[string]int{"192.168.0.0/17": 9})
+	got = entriesOf(a.Difference(b))
+	expected = []string{"10.0.0.0/8=1", "10.1.0.0/16=2", "192.168.128.0/17=3"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Difference returned %v, expected %v", got, expected)
+	}
+
+	if got := entriesOf(a.Difference(a)); len(got) != 0 {
+		t.Errorf("Difference with itself returned %v", got)
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	a := treeOf(t, map[string]int{"10.0.0.0/8": 1, "172.16.0.0/12": 2, "2001:db8::/32": 3})
+	b := treeOf(t, map[string]int{"10.1.0.0/16": 4, "10.2.0.0/16": 5, "172.0.0.0/8": 6, "2001:db9::/32": 7})
+
+	got := entriesOf(a.Intersect(b, func(x, y int) int { return x*10 + y }))
+	expected := []string{"10.1.0.0/16=14", "10.2.0.0/16=15", "172.16.0.0/12=26"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Intersect returned %v, expected %v", got, expected)
+	}
+
+	got = entriesOf(a.Intersect(b, nil))
+	expected = []string{"10.1.0.0/16=1", "10.2.0.0/16=1", "172.16.0.0/12=2"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Intersect without merge returned %v, expected %v", got, expected)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	a := treeOf(t, map[string]int{"0.0.0.0/0": 0, "10.0.0.0/8": 1, "2001:db8::/32": 2})
+	b := treeOf(t, map[string]int{"10.1.0.0/16": 3, "11.0.0.0/8": 4, "2001:db8::/32": 5})
+
+	got := entriesOf(a.Union(b, func(x, y int) int { return max(x, y) }))
+	expected := []string{"0.0.0.0/0=0", "10.0.0.0/8=1", "10.1.0.0/16=3", "11.0.0.0/8=4", "2001:db8::/32=5"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Union returned %v, expected %v", got, expected)
+	}
+
+	got = entriesOf(b.Union(a, nil))
+	expected = []string{"0.0.0.0/0=0", "10.0.0.0/8=1", "10.1.0.0/16=3", "11.0.0.0/8=4", "2001:db8::/32=2"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Union without merge returned %v, expected %v", got, expected)
+	}
+
+	// Every address keeps the value a lookup in the inputs would give it.
+	u := a.Union(b, func(x, y int) int { return max(x, y) })
+	for _, addr := range []string{"1.1.1.1", "10.0.0.1", "10.1.0.1", "11.1.1.1", "2001:db8::1"} {
+		va, _, _ := a.GetByString(addr)
+		vb, fb, _ := b.GetByString(addr)
+		want := va
+		if fb {
+			want = max(va, vb)
+		}
+		if got, _, _ := u.GetByString(addr); got != want {
+			t.Errorf("Union lookup of %s returned %d, expected %d", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package iptree
+
+import (
+	"iter"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// SyncTree is a Tree that is safe for concurrent use. Changes are made to a
+// Tree one at a time under a mutex, and after each change the tree's
+// snapshot, a PersistentTree sharing all but the changed paths with the
+// previous one, is published atomically. Lookups, walks and iterators read
+// the published snapshot without taking any lock, so they neither wait for
+// each other nor for writers.
+//
+// Keeping the snapshot up to date costs a copy of the path to every changed
+// entry, and memory for the snapshot alongside the tree. Walks and iterators
+// see the snapshot current when they start; changes made meanwhile, including
+// by their own callbacks, show up in later ones.
+type SyncTree[V any] struct {
+	mu      sync.Mutex // serializes changes
+	t       *Tree[V]
+	current atomic.Pointer[PersistentTree[V]]
+}
+
+// SyncIPTree is the untyped SyncTree.
+type SyncIPTree = SyncTree[any]
+
+// NewSync returns an empty untyped SyncIPTree.
+func NewSync() *SyncIPTree {
+	return NewSyncTree[any]()
+}
+
+// NewSyncTree returns an empty SyncTree holding values of type V.
+func NewSyncTree[V any]() *SyncTree[V] {
+	s := &SyncTree[V]{t: NewTree[V]()}
+	s.current.Store(s.t.Snapshot())
+	return s
+}
+
+// Load returns the current snapshot, for a consistent view across several
+// lookups.
+func (s *SyncTree[V]) Load() *PersistentTree[V] {
+	return s.current.Load()
+}
+
+// Read calls fn with the tree changes are made to, holding off changes until
+// it returns, for the methods only a Tree has. Lookups are not held off. fn
+// must not modify the tree.
+func (s *SyncTree[V]) Read(fn func(t *Tree[V])) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.t)
+}
+
+// Update calls fn with the tree, holding off other changes, and publishes its
+// snapshot once fn returns, so a group of changes is applied without readers
+// seeing it half done. Changes fn made before returning an error are
+// published too, as they are by the methods making a single change.
+func (s *SyncTree[V]) Update(fn func(t *Tree[V]) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := fn(s.t)
+	s.current.Store(s.t.Snapshot())
+	return err
+}
+
+func (s *SyncTree[V]) SetHostBitsPolicy(policy HostBitsPolicy, warn func(given, masked netip.Prefix)) {
+	s.Update(func(t *Tree[V]) error {
+		t.SetHostBitsPolicy(policy, warn)
+		return nil
+	})
+}
+
+func (s *SyncTree[V]) SetMappedPolicy(policy MappedPolicy) {
+	s.Update(func(t *Tree[V]) error {
+		t.SetMappedPolicy(policy)
+		return nil
+	})
+}
+
+func (s *SyncTree[V]) SetZonePolicy(policy ZonePolicy) {
+	s.Update(func(t *Tree[V]) error {
+		t.SetZonePolicy(policy)
+		return nil
+	})
+}
+
+func (s *SyncTree[V]) Zones() []string {
+	return s.Load().Zones()
+}
+
+func (s *SyncTree[V]) Add(cidr *net.IPNet, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.Add(cidr, v)
+	})
+}
+
+func (s *SyncTree[V]) AddIfAbsent(cidr *net.IPNet, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddIfAbsent(cidr, v)
+	})
+}
+
+func (s *SyncTree[V]) AddByString(ipcidr string, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddByString(ipcidr, v)
+	})
+}
+
+func (s *SyncTree[V]) AddByStringIfAbsent(ipcidr string, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddByStringIfAbsent(ipcidr, v)
+	})
+}
+
+func (s *SyncTree[V]) AddByNetIP(ipcidr net.IP, mask net.IPMask, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddByNetIP(ipcidr, mask, v)
+	})
+}
+
+func (s *SyncTree[V]) AddByNetIPIfAbsent(ipcidr net.IP, mask net.IPMask, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddByNetIPIfAbsent(ipcidr, mask, v)
+	})
+}
+
+func (s *SyncTree[V]) AddByNetIPAddr(ipcidr netip.Addr, mask netip.Prefix, v V, overwrite bool) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddByNetIPAddr(ipcidr, mask, v, overwrite)
+	})
+}
+
+func (s *SyncTree[V]) AddRange(from, to netip.Addr, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddRange(from, to, v)
+	})
+}
+
+func (s *SyncTree[V]) AddRangeIfAbsent(from, to netip.Addr, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddRangeIfAbsent(from, to, v)
+	})
+}
+
+func (s *SyncTree[V]) AddBatch(cidrs []string, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddBatch(cidrs, v)
+	})
+}
+
+func (s *SyncTree[V]) AddBatchIfAbsent(cidrs []string, v V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.AddBatchIfAbsent(cidrs, v)
+	})
+}
+
+func (s *SyncTree[V]) Upsert(prefix netip.Prefix, fn func(old V, exists bool) V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.Upsert(prefix, fn)
+	})
+}
+
+func (s *SyncTree[V]) UpsertByString(ipcidr string, fn func(old V, exists bool) V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.UpsertByString(ipcidr, fn)
+	})
+}
+
+func (s *SyncTree[V]) UpsertBatch(cidrs []string, fn func(old V, exists bool) V) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.UpsertBatch(cidrs, fn)
+	})
+}
+
+func (s *SyncTree[V]) DeleteByString(ipstr string) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.DeleteByString(ipstr)
+	})
+}
+
+func (s *SyncTree[V]) DeleteByNetIP(ip net.IP, mask net.IPMask) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.DeleteByNetIP(ip, mask)
+	})
+}
+
+func (s *SyncTree[V]) DeleteByNetIPAddr(nip netip.Addr, mask netip.Prefix) error {
+	return s.Update(func(t *Tree[V]) error {
+		return t.DeleteByNetIPAddr(nip, mask)
+	})
+}
+
+func (s *SyncTree[V]) DeleteSubtree(prefix netip.Prefix) (int, error) {
+	var removed int
+	err := s.Update(func(t *Tree[V]) error {
+		var err error
+		removed, err = t.DeleteSubtree(prefix)
+		return err
+	})
+	return removed, err
+}
+
+func (s *SyncTree[V]) DeleteSubtreeByString(ipcidr string) (int, error) {
+	var removed int
+	err := s.Update(func(t *Tree[V]) error {
+		var err error
+		removed, err = t.DeleteSubtreeByString(ipcidr)
+		return err
+	})
+	return removed, err
+}
+
+func (s *SyncTree[V]) Len() int {
+	return s.Load().Len()
+}
+
+func (s *SyncTree[V]) LenV4() int {
+	return s.Load().LenV4()
+}
+
+func (s *SyncTree[V]) LenV6() int {
+	return s.Load().LenV6()
+}
+
+func (s *SyncTree[V]) Get(ip net.IP) (V, bool, error) {
+	return s.Load().Get(ip)
+}
+
+func (s *SyncTree[V]) GetByString(ipstr string) (V, bool, error) {
+	return s.Load().GetByString(ipstr)
+}
+
+func (s *SyncTree[V]) GetIPNet(ip net.IPNet) (V, bool, error) {
+	return s.Load().GetIPNet(ip)
+}
+
+func (s *SyncTree[V]) GetNetIP(ip net.IP) (V, bool, error) {
+	return s.Load().GetNetIP(ip)
+}
+
+func (s *SyncTree[V]) GetNetIPAddr(nip netip.Addr) (V, bool, error) {
+	return s.Load().GetNetIPAddr(nip)
+}
+
+func (s *SyncTree[V]) GetBatch(addrs []netip.Addr, out []V, found []bool) {
+	s.Load().GetBatch(addrs, out, found)
+}
+
+func (s *SyncTree[V]) GetWithPrefixByString(ipstr string) (V, netip.Prefix, bool, error) {
+	return s.Load().GetWithPrefixByString(ipstr)
+}
+
+func (s *SyncTree[V]) GetWithPrefixNetIP(ip net.IP) (V, netip.Prefix, bool, error) {
+	return s.Load().GetWithPrefixNetIP(ip)
+}
+
+func (s *SyncTree[V]) GetWithPrefixNetIPAddr(nip netip.Addr) (V, netip.Prefix, bool, error) {
+	return s.Load().GetWithPrefixNetIPAddr(nip)
+}
+
+func (s *SyncTree[V]) GetAllMatches(nip netip.Addr) []Entry[V] {
+	return s.Load().GetAllMatches(nip)
+}
+
+func (s *SyncTree[V]) GetAllMatchesByString(ipstr string) ([]Entry[V], error) {
+	return s.Load().GetAllMatchesByString(ipstr)
+}
+
+func (s *SyncTree[V]) GetExact(prefix netip.Prefix) (V, bool) {
+	return s.Load().GetExact(prefix)
+}
+
+func (s *SyncTree[V]) GetExactByString(ipcidr string) (V, bool, error) {
+	return s.Load().GetExactByString(ipcidr)
+}
+
+func (s *SyncTree[V]) GetExactIPNet(cidr *net.IPNet) (V, bool, error) {
+	return s.Load().GetExactIPNet(cidr)
+}
+
+func (s *SyncTree[V]) HasPrefix(prefix netip.Prefix) bool {
+	return s.Load().HasPrefix(prefix)
+}
+
+func (s *SyncTree[V]) HasPrefixByString(ipcidr string) (bool, error) {
+	return s.Load().HasPrefixByString(ipcidr)
+}
+
+func (s *SyncTree[V]) HasPrefixIPNet(cidr *net.IPNet) (bool, error) {
+	return s.Load().HasPrefixIPNet(cidr)
+}
+
+func (s *SyncTree[V]) GetAll() map[string]V {
+	return s.Load().GetAll()
+}
+
+func (s *SyncTree[V]) GetAllWithin(prefix netip.Prefix) []Entry[V] {
+	return s.Load().GetAllWithin(prefix)
+}
+
+func (s *SyncTree[V]) WalkWithin(prefix netip.Prefix, callback func(prefix netip.Prefix, value V) error) error {
+	return s.Load().WalkWithin(prefix, callback)
+}
+
+func (s *SyncTree[V]) WalkV4Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return s.Load().WalkV4Prefix(callback)
+}
+
+func (s *SyncTree[V]) WalkV4String(callback func(prefix string, value V) error) error {
+	return s.Load().WalkV4String(callback)
+}
+
+func (s *SyncTree[V]) WalkV6Prefix(callback func(prefix netip.Prefix, value V) error) error {
+	return s.Load().WalkV6Prefix(callback)
+}
+
+func (s *SyncTree[V]) WalkV6String(callback func(prefix string, value V) error) error {
+	return s.Load().WalkV6String(callback)
+}
+
+func (s *SyncTree[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		s.Load().All()(yield)
+	}
+}
+
+func (s *SyncTree[V]) AllV4() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		s.Load().AllV4()(yield)
+	}
+}
+
+func (s *SyncTree[V]) AllV6() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		s.Load().AllV6()(yield)
+	}
+}
+
+func (s *SyncTree[V]) Within(prefix netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		s.Load().Within(prefix)(yield)
+	}
+}
+
+func (s *SyncTree[V]) Freeze() *FrozenTree[V] {
+	var f *FrozenTree[V]
+	s.Read(func(t *Tree[V]) {
+		f = t.Freeze()
+	})
+	return f
+}
@@ -0,0 +1,114 @@
+package iptree
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestSyncTree(t *testing.T) {
+	ip := NewSyncTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	ip.AddByString("2001:db8::/32", 2)
+	if val, found, _ := ip.GetNetIPAddr(netip.MustParseAddr("10.1.1.1")); !found || val != 1 {
+		t.Errorf("Lookup returned %d, %v", val, found)
+	}
+
+	err := ip.Update(func(tree *Tree[int]) error {
+		if err := tree.DeleteByString("10.0.0.0/8"); err != nil {
+			return err
+		}
+		return tree.AddByString("11.0.0.0/8", 3)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	ip.Read(func(tree *Tree[int]) {
+		if tree.HasPrefix(netip.MustParsePrefix("10.0.0.0/8")) || !tree.HasPrefix(netip.MustParsePrefix("11.0.0.0/8")) {
+			t.Error("Update was not applied")
+		}
+	})
+	if ip.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", ip.Len())
+	}
+}
+
+// TestSyncTreeConcurrent is meant to be run with the race detector.
+func TestSyncTreeConcurrent(t *testing.T) {
+	ip := NewSyncTree[int]()
+	ip.AddByString("0.0.0.0/0", 0)
+	ip.AddByString("::/0", 0)
+
+	const rounds = 200
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < rounds; n++ {
+			ip.AddByString(fmt.Sprintf("10.%d.0.0/16", n%256), n)
+			ip.AddByString(fmt.Sprintf("2001:db8:%x::/48", n), n)
+			if n%3 == 0 {
+				ip.DeleteByString(fmt.Sprintf("10.%d.0.0/16", n%256))
+			}
+			if n%50 == 49 {
+				ip.DeleteSubtree(netip.MustParsePrefix("2001:db8::/32"))
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < rounds; n++ {
+				addr := netip.AddrFrom4([4]byte{10, byte(n), 1, 1})
+				if _, found, err := ip.GetNetIPAddr(addr); err != nil || !found {
+					t.Errorf("Lookup of %s returned %v, %v", addr, found, err)
+				}
+				ip.GetWithPrefixByString("2001:db8:1::1")
+				ip.GetAllMatches(addr)
+				count := 0
+				ip.WalkV4Prefix(func(prefix netip.Prefix, value int) error {
+					count++
+					return nil
+				})
+				for range ip.AllV6() {
+					count++
+				}
+				ip.Len()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSyncTreeSnapshot(t *testing.T) {
+	ip := NewSyncTree[int]()
+	ip.AddByString("10.0.0.0/8", 1)
+	before := ip.Load()
+
+	// Walks read a snapshot, so their callbacks may change the tree.
+	err := ip.WalkV4Prefix(func(prefix netip.Prefix, value int) error {
+		return ip.AddByString("11.0.0.0/8", value+1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Len() != 2 || before.Len() != 1 {
+		t.Errorf("Expected 2 entries and 1 in the earlier snapshot, got %d and %d", ip.Len(), before.Len())
+	}
+	if v, found, _ := ip.GetByString("11.1.1.1"); !found || v != 2 {
+		t.Errorf("Lookup returned %d, %v", v, found)
+	}
+
+	// Changes made before an error are published, as in a Tree.
+	ip.Update(func(tree *Tree[int]) error {
+		tree.AddByString("12.0.0.0/8", 3)
+		return tree.AddByString("bogus", 4)
+	})
+	if !ip.HasPrefix(netip.MustParsePrefix("12.0.0.0/8")) {
+		t.Error("Change made before the error was not published")
+	}
+}
@@ -0,0 +1,142 @@
+package iptree
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ZonePolicy decides what the zone of an IPv6 address such as fe80::1%eth0
+// means to a tree. Zones are given on netip.Addr arguments, or in strings as
+// fe80::1%eth0 or, for prefixes, fe80::%eth0/64.
+type ZonePolicy int
+
+const (
+	// ZoneStrip ignores zones, so fe80::1%eth0 is treated as fe80::1. It is
+	// the default.
+	ZoneStrip ZonePolicy = iota
+	// ZoneScoped keeps entries added with a zone apart from all others. A
+	// lookup of an address in a zone matches that zone's entries, falling
+	// back to the entries without a zone, while a lookup without a zone never
+	// matches zone-scoped entries. Deleting or getting exactly a prefix in a
+	// zone only considers that zone's entries.
+	//
+	// Zone-scoped entries are counted by Len and LenV6 and kept by Clone,
+	// Snapshot and Freeze, but are otherwise only reachable through Zone:
+	// walks, iterators, Ranges and set operations cover the entries without
+	// a zone.
+	ZoneScoped
+)
+
+// SetZonePolicy sets how zones of IPv6 addresses are treated. It should be set
+// before entries are added.
+func (i *Tree[V]) SetZonePolicy(policy ZonePolicy) {
+	i.opts.zone = policy
+	if i.snap != nil {
+		i.track(i.snap.withOptions(i.opts))
+	}
+}
+
+// setOptions sets the policies of i and the trees of its zones.
+func (i *Tree[V]) setOptions(opts options) {
+	i.opts = opts
+	if i.snap != nil {
+		i.track(i.snap.withOptions(opts))
+	}
+	for _, z := range i.zones {
+		z.setOptions(opts)
+	}
+}
+
+// Zone returns the tree holding the entries scoped to zone, or nil if there
+// are none. Changes made to it are changes to i.
+func (i *Tree[V]) Zone(zone string) *Tree[V] {
+	return i.zones[zone]
+}
+
+// Zones returns the names of the zones holding entries, sorted.
+func (i *Tree[V]) Zones() []string {
+	var names []string
+	for name, z := range i.zones {
+		if z.Len() > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// scope returns the tree zone-scoped lookups of zone should try before i, or
+// nil if there is none.
+func (i *Tree[V]) scope(zone string) *Tree[V] {
+	if zone == "" || i.opts.zone != ZoneScoped {
+		return nil
+	}
+	return i.zones[zone]
+}
+
+// target returns the tree holding the entries of zone: i itself for addresses
+// without a zone or when zones are stripped, otherwise the zone's tree, which
+// is created if create is set and may be nil if not.
+func (i *Tree[V]) target(zone string, create bool) *Tree[V] {
+	if zone == "" || i.opts.zone != ZoneScoped {
+		return i
+	}
+	z := i.zones[zone]
+	if z == nil && create {
+		z = NewTree[V]()
+		z.opts = i.opts
+		i.setZone(zone, z)
+	}
+	return z
+}
+
+// setZone makes z the tree of the entries scoped to zone.
+func (i *Tree[V]) setZone(zone string, z *Tree[V]) {
+	if i.zones == nil {
+		i.zones = make(map[string]*Tree[V])
+	}
+	i.zones[zone] = z
+	z.parent, z.name = i, zone
+	if i.snap != nil {
+		i.track(i.snap.withZone(zone, z.Snapshot()))
+	}
+}
+
+// parseZoned parses a CIDR or a bare address, which is treated as a host
+// prefix, along with the IPv6 zone it may carry, written after the address as
+// in fe80::1%eth0 or fe80::%eth0/64.
+func parseZoned(s string) (netip.Prefix, string, error) {
+	pct := strings.IndexByte(s, '%')
+	if pct < 0 {
+		if strings.IndexByte(s, '/') >= 0 {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return netip.Prefix{}, "", invalidPrefix(s, err)
+			}
+			return prefix, "", nil
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, "", invalidPrefix(s, err)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), "", nil
+	}
+	zone, bits, hasBits := strings.Cut(s[pct+1:], "/")
+	addr, err := netip.ParseAddr(s[:pct] + "%" + zone)
+	if err != nil {
+		return netip.Prefix{}, "", invalidPrefix(s, err)
+	}
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	if hasBits {
+		n, err := strconv.Atoi(bits)
+		if err != nil {
+			return netip.Prefix{}, "", invalidPrefix(s, err)
+		}
+		if prefix = netip.PrefixFrom(addr, n); !prefix.IsValid() {
+			return netip.Prefix{}, "", invalidPrefix(s, nil)
+		}
+	}
+	return prefix, addr.Zone(), nil
+}
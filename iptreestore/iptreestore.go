@@ -3,13 +3,20 @@ package iptreestore
 import (
 	"bufio"
 	"encoding/gob"
+	"fmt"
+	"net/netip"
 	"os"
+	"strings"
 
 	"github.com/iqhive/go-iptree/iptree"
 )
 
-// SaveIPTree serializes and saves an IPTree to a file efficiently using gob encoding
-func SaveIPTreeToGob(tree *iptree.IPTree, filename string) error {
+// SaveIPTreeToGob serializes and saves a tree to a file efficiently using gob encoding.
+// Zone-scoped entries are saved too, and loading them sets ZoneScoped on the
+// loaded tree.
+// Trees saved with a concrete value type must be loaded with LoadTreeFromGob
+// using the same type.
+func SaveIPTreeToGob[V any](tree *iptree.Tree[V], filename string) error {
 	// Create or truncate the file
 	file, err := os.Create(filename)
 	if err != nil {
@@ -25,10 +32,10 @@ func SaveIPTreeToGob(tree *iptree.IPTree, filename string) error {
 	encoder := gob.NewEncoder(writer)
 
 	// Create a map to store the tree data
-	treeData := make(map[string]interface{})
+	treeData := make(map[string]V)
 
 	// Walk the tree and collect all IPv4 entries
-	err = tree.WalkV4String(func(prefix string, value interface{}) error {
+	err = tree.WalkV4String(func(prefix string, value V) error {
 		treeData[prefix] = value
 		return nil
 	})
@@ -36,7 +43,7 @@ func SaveIPTreeToGob(tree *iptree.IPTree, filename string) error {
 		return err
 	}
 	// Walk the tree and collect all IPv6 entries
-	err = tree.WalkV6String(func(prefix string, value interface{}) error {
+	err = tree.WalkV6String(func(prefix string, value V) error {
 		treeData[prefix] = value
 		return nil
 	})
@@ -44,12 +51,31 @@ func SaveIPTreeToGob(tree *iptree.IPTree, filename string) error {
 		return err
 	}
 
+	// Collect the zone-scoped entries, written with their zone as in
+	// fe80::%eth0/64. IPv4 addresses cannot carry a zone, so an IPv4-mapped
+	// entry the zone holds as IPv4 is written in its mapped form, which
+	// loading stores in the same place.
+	for _, zone := range tree.Zones() {
+		for prefix, value := range tree.Zone(zone).All() {
+			addr, bits := prefix.Addr(), prefix.Bits()
+			if addr.Is4() {
+				addr, bits = netip.AddrFrom16(addr.As16()), bits+96
+			}
+			treeData[fmt.Sprintf("%s/%d", addr.WithZone(zone), bits)] = value
+		}
+	}
+
 	// Encode and write the tree data
 	return encoder.Encode(treeData)
 }
 
-// LoadIPTree loads an IPTree from a file using gob decoding
+// LoadIPTreeFromGob loads an untyped IPTree from a file using gob decoding
 func LoadIPTreeFromGob(filename string) (*iptree.IPTree, error) {
+	return LoadTreeFromGob[any](filename)
+}
+
+// LoadTreeFromGob loads a tree holding values of type V from a file using gob decoding
+func LoadTreeFromGob[V any](filename string) (*iptree.Tree[V], error) {
 	// Open the file
 	file, err := os.Open(filename)
 	if err != nil {
@@ -64,7 +90,7 @@ func LoadIPTreeFromGob(filename string) (*iptree.IPTree, error) {
 	decoder := gob.NewDecoder(reader)
 
 	// Create map to decode into
-	treeData := make(map[string]interface{})
+	treeData := make(map[string]V)
 
 	// Decode the tree data
 	err = decoder.Decode(&treeData)
@@ -72,16 +98,45 @@ func LoadIPTreeFromGob(filename string) (*iptree.IPTree, error) {
 		return nil, err
 	}
 
-	// Create new tree
-	tree := iptree.New()
-
-	// Populate the tree
+	// Build the tree in one go, the map being in no particular order. Entries
+	// with a zone were saved from a tree scoping entries to zones.
+	builder := iptree.NewBuilder[V](len(treeData))
+	var zoned []string
 	for prefix, value := range treeData {
-		err = tree.AddByString(prefix, value)
+		if strings.IndexByte(prefix, '%') >= 0 {
+			zoned = append(zoned, prefix)
+			continue
+		}
+		err = builder.AddByString(prefix, value)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	tree, err := builder.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if len(zoned) > 0 {
+		tree.SetZonePolicy(iptree.ZoneScoped)
+	}
+	for _, prefix := range zoned {
+		err = tree.AddByString(prefix, treeData[prefix])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
 		}
 	}
 
 	return tree, nil
 }
+
+// ReloadTreeFromGob loads a tree from a file using gob decoding and publishes it
+// to dst. If loading fails, dst keeps serving the tree it held before.
+func ReloadTreeFromGob[V any](dst *iptree.AtomicTree[V], filename string) error {
+	tree, err := LoadTreeFromGob[V](filename)
+	if err != nil {
+		return err
+	}
+	dst.Store(tree.Snapshot())
+	return nil
+}
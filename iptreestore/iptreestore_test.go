@@ -1,6 +1,9 @@
 package iptreestore
 
 import (
+	"encoding/gob"
+	"errors"
+	"os"
 	"testing"
 
 	"github.com/iqhive/go-iptree/iptree"
@@ -27,7 +30,7 @@ func setupTestTree(t *testing.T, cidrs []string) *iptree.IPTree {
 func verifyTreeContents(t *testing.T, tree *iptree.IPTree, cidrs []string) {
 	t.Helper()
 	for _, cidr := range cidrs {
-		_, exists, err := tree.GetByString(cidr)
+		exists, err := tree.HasPrefixByString(cidr)
 		if err != nil {
 			t.Errorf("error checking CIDR %s: %v", cidr, err)
 		}
@@ -89,3 +92,105 @@ func TestIPTreeStorage(t *testing.T) {
 		})
 	}
 }
+
+func TestTypedIPTreeStorage(t *testing.T) {
+	cidrs := map[string]int{
+		"192.168.1.0/24": 1,
+		"10.0.0.0/8":     2,
+		"2001:db8::/32":  3,
+	}
+	originalTree := iptree.NewTree[int]()
+	for cidr, v := range cidrs {
+		if err := originalTree.AddByString(cidr, v); err != nil {
+			t.Fatalf("failed to insert CIDR %s: %v", cidr, err)
+		}
+	}
+
+	tempFile := t.TempDir() + "/typed.gob"
+	if err := SaveIPTreeToGob(originalTree, tempFile); err != nil {
+		t.Fatalf("SaveIPTreeToGob() error = %v", err)
+	}
+	loadedTree, err := LoadTreeFromGob[int](tempFile)
+	if err != nil {
+		t.Fatalf("LoadTreeFromGob() error = %v", err)
+	}
+
+	for cidr, want := range cidrs {
+		got, found, err := loadedTree.GetByString(cidr)
+		if err != nil || !found || got != want {
+			t.Errorf("CIDR %s: got %d, %v, %v; want %d", cidr, got, found, err, want)
+		}
+	}
+}
+
+func TestZonedIPTreeStorage(t *testing.T) {
+	tree := iptree.NewTree[int]()
+	tree.SetZonePolicy(iptree.ZoneScoped)
+	tree.AddByString("fe80::/10", 1)
+	tree.AddByString("fe80::%eth0/64", 2)
+	tree.AddByString("fe80::1%br-lan", 3)
+	tree.AddByString("::ffff:1.2.3.4%eth0/128", 4)
+	tree.AddByString("::ffff:10.0.0.0%eth0/104", 5)
+
+	tempFile := t.TempDir() + "/zoned.gob"
+	if err := SaveIPTreeToGob(tree, tempFile); err != nil {
+		t.Fatalf("SaveIPTreeToGob() error = %v", err)
+	}
+	loadedTree, err := LoadTreeFromGob[int](tempFile)
+	if err != nil {
+		t.Fatalf("LoadTreeFromGob() error = %v", err)
+	}
+	if loadedTree.Len() != tree.Len() {
+		t.Errorf("Loaded %d entries, expected %d", loadedTree.Len(), tree.Len())
+	}
+	for addr, want := range map[string]int{"fe80::1": 1, "fe80::1%eth0": 2, "fe80::1%br-lan": 3, "fe80::2%br-lan": 1, "::ffff:1.2.3.4%eth0": 4, "::ffff:10.1.1.1%eth0": 5} {
+		if got, _, _ := loadedTree.GetByString(addr); got != want {
+			t.Errorf("Lookup of %s returned %d, expected %d", addr, got, want)
+		}
+	}
+}
+
+func TestReloadTreeFromGob(t *testing.T) {
+	tree := iptree.NewTree[int]()
+	tree.AddByString("10.0.0.0/8", 1)
+	tempFile := t.TempDir() + "/reload.gob"
+	if err := SaveIPTreeToGob(tree, tempFile); err != nil {
+		t.Fatalf("SaveIPTreeToGob() error = %v", err)
+	}
+
+	served := iptree.NewAtomicTree[int](nil)
+	if err := ReloadTreeFromGob(served, tempFile); err != nil {
+		t.Fatalf("ReloadTreeFromGob() error = %v", err)
+	}
+	if val, found, _ := served.GetByString("10.1.2.3"); !found || val != 1 {
+		t.Errorf("Reloaded tree returned %d, %v", val, found)
+	}
+
+	if err := ReloadTreeFromGob(served, t.TempDir()+"/missing.gob"); err == nil {
+		t.Error("Expected error reloading from a missing file")
+	}
+	if served.Len() != 1 {
+		t.Errorf("Failed reload replaced the served tree")
+	}
+}
+
+func TestLoadInvalidPrefix(t *testing.T) {
+	tempFile := t.TempDir() + "/invalid.gob"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(file).Encode(map[string]int{"10.0.0.0/33": 1}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	_, err = LoadTreeFromGob[int](tempFile)
+	if !errors.Is(err, iptree.ErrInvalidPrefix) {
+		t.Errorf("LoadTreeFromGob returned %v, expected ErrInvalidPrefix", err)
+	}
+	var perr *iptree.PrefixError
+	if !errors.As(err, &perr) || perr.Input != "10.0.0.0/33" {
+		t.Errorf("LoadTreeFromGob did not report the invalid prefix: %v", err)
+	}
+}